@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Purposes of user tokens: single-use secrets mailed to a user.
+const (
+	TokenVerifyEmail   = "verify_email"
+	TokenResetPassword = "reset_password"
+)
+
+var (
+	ErrInvalidUserToken   = errors.New("invalid or expired token")
+	ErrRegistrationClosed = errors.New("registration is disabled")
+	ErrAlreadyVerified    = errors.New("email is already verified")
+	ErrWrongPassword      = errors.New("current password is wrong")
+)
+
+// issueUserToken creates a token for purpose, replacing the unused ones the
+// user already has for it, and returns its plain value. Only its hash is
+// stored.
+func issueUserToken(ctx context.Context, q querier, userID int64, purpose string, ttl time.Duration) (string, error) {
+	if _, err := q.ExecContext(ctx, "DELETE FROM user_tokens WHERE user_id = $1 AND purpose = $2 AND used_at IS NULL", userID, purpose); err != nil {
+		return "", err
+	}
+	tok := randomToken(32)
+	_, err := q.ExecContext(ctx, "INSERT INTO user_tokens (token_hash, user_id, purpose, expires_at) VALUES ($1, $2, $3, $4)",
+		hashToken(tok), userID, purpose, time.Now().Add(ttl))
+	return tok, err
+}
+
+// consumeUserToken spends a token issued for purpose and returns its user.
+func consumeUserToken(ctx context.Context, q querier, purpose, tok string) (int64, error) {
+	var userID int64
+	err := q.QueryRowContext(ctx, `UPDATE user_tokens SET used_at = NOW()
+		WHERE token_hash = $1 AND purpose = $2 AND used_at IS NULL AND expires_at > NOW() RETURNING user_id`,
+		hashToken(tok), purpose).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) { return 0, ErrInvalidUserToken }
+	return userID, err
+}
+
+// AccountOptions configures self-service accounts.
+type AccountOptions struct {
+	AllowRegistration bool
+	// RegistrationRole is given to users who sign up themselves.
+	RegistrationRole string
+	VerifyEmailTTL   time.Duration
+	// VerifyEmailURL is the page that confirms an address; {token} is
+	// replaced by the verification token.
+	VerifyEmailURL string
+	ResetPasswordTTL time.Duration
+	// ResetPasswordInterval is the least time between two reset mails to
+	// the same address.
+	ResetPasswordInterval time.Duration
+	// ResetPasswordURL is the page that sets a new password; {token} is
+	// replaced by the reset token.
+	ResetPasswordURL string
+}
+
+// AccountService handles what users do to their own accounts.
+type AccountService struct {
+	db     DB
+	users  *UserService
+	mailer Mailer
+	site   Site
+	opts   AccountOptions
+}
+
+func NewAccountService(db DB, users *UserService, mailer Mailer, site Site, opts AccountOptions) *AccountService {
+	return &AccountService{db: db, users: users, mailer: mailer, site: site, opts: opts}
+}
+
+// Register creates an unverified account and mails a verification link.
+// A failed delivery is only logged: the user can ask for another link.
+func (s *AccountService) Register(ctx context.Context, email, password string) (*User, error) {
+	if !s.opts.AllowRegistration { return nil, ErrRegistrationClosed }
+	u, err := s.users.create(ctx, email, password, s.opts.RegistrationRole, false)
+	if err != nil { return nil, err }
+	if err := s.SendVerification(ctx, u); err != nil { log.Printf("verification mail to %s failed: %v", u.Email, err) }
+	return u, nil
+}
+
+// SendVerification mails a new verification link, invalidating older ones.
+func (s *AccountService) SendVerification(ctx context.Context, u *User) error {
+	if u.EmailVerifiedAt != nil { return ErrAlreadyVerified }
+	tok, err := issueUserToken(ctx, s.db, u.ID, TokenVerifyEmail, s.opts.VerifyEmailTTL)
+	if err != nil { return err }
+	link := strings.ReplaceAll(s.opts.VerifyEmailURL, "{token}", tok)
+	return s.mailer.Send(ctx, Mail{
+		To:      u.Email,
+		Subject: "Подтвердите адрес почты — " + s.site.Title,
+		Body: fmt.Sprintf("Здравствуйте!\n\nЧтобы подтвердить адрес %s на сайте %s, перейдите по ссылке:\n\n%s\n\nСсылка действует до %s. Если вы не регистрировались, просто проигнорируйте это письмо.\n",
+			u.Email, s.site.Title, link, time.Now().Add(s.opts.VerifyEmailTTL).UTC().Format("02.01.2006 15:04 UTC")),
+	})
+}
+
+// VerifyEmail confirms the address of the user a token was mailed to.
+func (s *AccountService) VerifyEmail(ctx context.Context, tok string) (*User, error) {
+	var userID int64
+	err := withTx(ctx, s.db, func(tx *sql.Tx) error {
+		var err error
+		if userID, err = consumeUserToken(ctx, tx, TokenVerifyEmail, tok); err != nil { return err }
+		_, err = tx.ExecContext(ctx, "UPDATE users SET email_verified_at = COALESCE(email_verified_at, NOW()) WHERE id = $1", userID)
+		return err
+	})
+	if err != nil { return nil, err }
+	return s.users.GetByID(ctx, userID)
+}
+
+// RequestPasswordReset runs ForgotPassword in the background, so that the
+// caller neither waits for the mail server nor learns from the response or
+// its timing whether the email has an account. Failures are only logged.
+func (s *AccountService) RequestPasswordReset(email string) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if err := s.ForgotPassword(ctx, email); err != nil { log.Printf("password reset for %s failed: %v", email, err) }
+	}()
+}
+
+// ForgotPassword mails a password reset link to the user with the given
+// email. Unknown and disabled accounts are skipped silently, and so are
+// requests within ResetPasswordInterval of the previous link, so the
+// endpoint cannot be used to flood someone's inbox.
+func (s *AccountService) ForgotPassword(ctx context.Context, email string) error {
+	u, err := s.users.GetByEmail(ctx, strings.TrimSpace(email))
+	if errors.Is(err, ErrNotFound) { return nil }
+	if err != nil { return err }
+	if u.DisabledAt != nil { return nil }
+	var tok string
+	err = withTx(ctx, s.db, func(tx *sql.Tx) error {
+		// Locking the user serializes concurrent requests for the same address.
+		if _, err := tx.ExecContext(ctx, "SELECT 1 FROM users WHERE id = $1 FOR UPDATE", u.ID); err != nil { return err }
+		var recent bool
+		err := tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM user_tokens WHERE user_id = $1 AND purpose = $2 AND created_at > $3)",
+			u.ID, TokenResetPassword, time.Now().Add(-s.opts.ResetPasswordInterval)).Scan(&recent)
+		if err != nil || recent { return err }
+		tok, err = issueUserToken(ctx, tx, u.ID, TokenResetPassword, s.opts.ResetPasswordTTL)
+		return err
+	})
+	if err != nil || tok == "" { return err }
+	link := strings.ReplaceAll(s.opts.ResetPasswordURL, "{token}", tok)
+	return s.mailer.Send(ctx, Mail{
+		To:      u.Email,
+		Subject: "Сброс пароля — " + s.site.Title,
+		Body: fmt.Sprintf("Здравствуйте!\n\nЧтобы задать новый пароль для %s на сайте %s, перейдите по ссылке:\n\n%s\n\nСсылка действует до %s и только один раз. Если вы не запрашивали сброс, просто проигнорируйте это письмо.\n",
+			u.Email, s.site.Title, link, time.Now().Add(s.opts.ResetPasswordTTL).UTC().Format("02.01.2006 15:04 UTC")),
+	})
+}
+
+// ResetPassword sets the password of the user a reset token was mailed to
+// and ends their sessions. Following the link proves the address, so it
+// also counts as verified.
+func (s *AccountService) ResetPassword(ctx context.Context, tok, password string) (*User, error) {
+	var userID int64
+	err := s.users.setPasswordFor(ctx, password, func(tx *sql.Tx) (int64, error) {
+		var err error
+		if userID, err = consumeUserToken(ctx, tx, TokenResetPassword, tok); err != nil { return 0, err }
+		var disabled bool
+		err = tx.QueryRowContext(ctx, "SELECT disabled_at IS NOT NULL OR deleted_at IS NOT NULL FROM users WHERE id = $1", userID).Scan(&disabled)
+		if err != nil || disabled { return 0, ErrInvalidUserToken }
+		_, err = tx.ExecContext(ctx, "UPDATE users SET email_verified_at = COALESCE(email_verified_at, NOW()) WHERE id = $1", userID)
+		return userID, err
+	})
+	if err != nil { return nil, err }
+	return s.users.GetByID(ctx, userID)
+}
+
+// ChangePassword replaces the password of a user who knows the current one
+// and ends all of their sessions.
+func (s *AccountService) ChangePassword(ctx context.Context, userID int64, current, password string) error {
+	u, err := s.users.GetByID(ctx, userID)
+	if err != nil { return err }
+	if !s.users.passwordHasher.VerifyPassword(u.PasswordHash, current) { return ErrWrongPassword }
+	return s.users.SetPassword(ctx, userID, password)
+}
+
+// PurgeTokens removes user tokens that expired before the given time.
+func (s *AccountService) PurgeTokens(ctx context.Context, before time.Time) (int64, error) {
+	res, err := s.db.ExecContext(ctx, "DELETE FROM user_tokens WHERE expires_at < $1", before)
+	if err != nil { return 0, err }
+	return res.RowsAffected()
+}
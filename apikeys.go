@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// apiKeyPrefix marks API keys, so the auth middleware can tell them from
+// JWTs and secret scanners can find leaked ones.
+const apiKeyPrefix = "mk_"
+
+// apiKeyPrefixAttempts is how many random prefixes Create tries.
+const apiKeyPrefixAttempts = 5
+
+var ErrInvalidAPIKey = errors.New("invalid API key")
+
+// APIKey is a long-lived credential of a user for scripts. Its requests get
+// the permissions of the user's role that are also among Scopes. The key
+// itself is shown once, on creation; Prefix identifies it afterwards.
+type APIKey struct {
+	ID         int64      `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+type APIKeyService struct {
+	db               DB
+	requireAdminTOTP bool
+}
+
+func NewAPIKeyService(db DB, requireAdminTOTP bool) *APIKeyService {
+	return &APIKeyService{db: db, requireAdminTOTP: requireAdminTOTP}
+}
+
+// splitAPIKey returns the prefix of a key of the form mk_<prefix>_<secret>.
+func splitAPIKey(key string) (string, bool) {
+	rest, ok := strings.CutPrefix(key, apiKeyPrefix)
+	if !ok || len(rest) < 10 || rest[8] != '_' { return "", false }
+	return rest[:8], true
+}
+
+const apiKeyColumns = "id, name, prefix, scopes, created_at, expires_at, last_used_at, revoked_at"
+
+func scanAPIKey(row rowScanner) (*APIKey, error) {
+	k := &APIKey{}
+	if err := row.Scan(&k.ID, &k.Name, &k.Prefix, pq.Array(&k.Scopes), &k.CreatedAt, &k.ExpiresAt, &k.LastUsedAt, &k.RevokedAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) { return nil, ErrNotFound }
+		return nil, err
+	}
+	if k.Scopes == nil { k.Scopes = []string{} }
+	return k, nil
+}
+
+// Create issues a key and returns it with its plain value.
+func (s *APIKeyService) Create(ctx context.Context, userID int64, name string, scopes []string, expiresAt *time.Time) (*APIKey, string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" { return nil, "", errors.New("name is required") }
+	scopes, err := validatePermissions(scopes)
+	if err != nil { return nil, "", err }
+	if len(scopes) == 0 { return nil, "", errors.New("at least one scope is required") }
+	if expiresAt != nil && !expiresAt.After(time.Now()) { return nil, "", errors.New("expires_at must be in the future") }
+	// Prefixes are short enough to collide once there are many keys; a
+	// taken one inserts nothing and a new one is drawn.
+	for attempt := 0; attempt < apiKeyPrefixAttempts; attempt++ {
+		b := make([]byte, 4)
+		if _, err := rand.Read(b); err != nil { return nil, "", err }
+		prefix := hex.EncodeToString(b)
+		key := apiKeyPrefix + prefix + "_" + randomToken(32)
+		k, err := scanAPIKey(s.db.QueryRowContext(ctx, `INSERT INTO api_keys (user_id, name, prefix, key_hash, scopes, expires_at)
+			VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (prefix) DO NOTHING RETURNING `+apiKeyColumns, userID, name, prefix, hashToken(key), pq.Array(scopes), expiresAt))
+		if errors.Is(err, ErrNotFound) { continue }
+		if err != nil { return nil, "", err }
+		return k, key, nil
+	}
+	return nil, "", errors.New("could not generate a unique API key prefix")
+}
+
+// List returns the keys of a user, revoked ones included, newest first.
+func (s *APIKeyService) List(ctx context.Context, userID int64) ([]*APIKey, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT "+apiKeyColumns+" FROM api_keys WHERE user_id = $1 ORDER BY id DESC", userID)
+	if err != nil { return nil, err }
+	defer rows.Close()
+	keys := []*APIKey{}
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil { return nil, err }
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// Revoke stops a key of the user from working.
+func (s *APIKeyService) Revoke(ctx context.Context, userID, id int64) error {
+	res, err := s.db.ExecContext(ctx, "UPDATE api_keys SET revoked_at = NOW() WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL", id, userID)
+	if err != nil { return err }
+	if n, _ := res.RowsAffected(); n == 0 { return ErrNotFound }
+	return nil
+}
+
+// Authenticate returns the user of a key, with its scopes, or
+// ErrInvalidAPIKey if the key is unknown, revoked or expired, or its user
+// has been deleted or disabled.
+func (s *APIKeyService) Authenticate(ctx context.Context, key string) (int64, *sessionUser, error) {
+	prefix, ok := splitAPIKey(key)
+	if !ok { return 0, nil, ErrInvalidAPIKey }
+	var id, userID int64
+	var hash string
+	var scopes []string
+	var totp bool
+	u := &sessionUser{}
+	err := s.db.QueryRowContext(ctx, `SELECT k.id, k.key_hash, k.scopes, u.id, u.role, u.email_verified_at IS NOT NULL, u.totp_enabled_at IS NOT NULL
+		FROM api_keys k JOIN users u ON u.id = k.user_id
+		WHERE k.prefix = $1 AND k.revoked_at IS NULL AND (k.expires_at IS NULL OR k.expires_at > NOW()) AND u.deleted_at IS NULL AND u.disabled_at IS NULL`, prefix).
+		Scan(&id, &hash, pq.Array(&scopes), &userID, &u.Role, &u.Verified, &totp)
+	if errors.Is(err, sql.ErrNoRows) { return 0, nil, ErrInvalidAPIKey }
+	if err != nil { return 0, nil, err }
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(hashToken(key))) != 1 { return 0, nil, ErrInvalidAPIKey }
+	u.NeedsTOTP = s.requireAdminTOTP && u.Role == RoleAdmin && !totp
+	u.Scopes = map[string]bool{}
+	for _, sc := range scopes { u.Scopes[sc] = true }
+	// last_used_at is only written once a minute, so that busy scripts do
+	// not turn every request into a write.
+	if _, err := s.db.ExecContext(ctx, "UPDATE api_keys SET last_used_at = NOW() WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL '1 minute')", id); err != nil {
+		return 0, nil, err
+	}
+	return userID, u, nil
+}
@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestSplitAPIKey(t *testing.T) {
+	tests := []struct {
+		key, prefix string
+		ok          bool
+	}{
+		{"mk_0123abcd_secretpart", "0123abcd", true},
+		{"mk_0123abcd_s", "0123abcd", true},
+		{"mk_0123abcd_", "", false},
+		{"mk_0123abcd", "", false},
+		{"mk_0123abc_secret", "", false},
+		{"mk__0123abcdsecret", "", false},
+		{"xx_0123abcd_secret", "", false},
+		{"0123abcd_secret", "", false},
+		{"", "", false},
+		{"eyJhbGciOiJIUzI1NiJ9.e30.sig", "", false},
+	}
+	for _, tt := range tests {
+		prefix, ok := splitAPIKey(tt.key)
+		if prefix != tt.prefix || ok != tt.ok { t.Errorf("splitAPIKey(%q) = %q, %v, want %q, %v", tt.key, prefix, ok, tt.prefix, tt.ok) }
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// Audit actions.
+const (
+	AuditLoginLocked      = "login.locked"
+	AuditLoginUnlocked    = "login.unlocked"
+	AuditTOTPEnabled      = "2fa.enabled"
+	AuditTOTPDisabled     = "2fa.disabled"
+	AuditRecoveryCodeUsed = "2fa.recovery_code_used"
+)
+
+// AuditEntry is one security-relevant event. ActorID is the user who caused
+// it, nil for anonymous requests and background work.
+type AuditEntry struct {
+	ID        int64           `json:"id"`
+	Action    string          `json:"action"`
+	ActorID   *int64          `json:"actor_id"`
+	Subject   string          `json:"subject"`
+	IP        string          `json:"ip,omitempty"`
+	Details   json.RawMessage `json:"details,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// AuditLog is an append-only trail of security events.
+type AuditLog struct {
+	db DB
+}
+
+func NewAuditLog(db DB) *AuditLog { return &AuditLog{db: db} }
+
+func (a *AuditLog) Record(ctx context.Context, action string, actorID *int64, subject, ip string, details any) error {
+	return recordAudit(ctx, a.db, action, actorID, subject, ip, details)
+}
+
+// recordAudit appends an entry; details, if not nil, are stored as JSON.
+func recordAudit(ctx context.Context, q querier, action string, actorID *int64, subject, ip string, details any) error {
+	var raw []byte
+	if details != nil {
+		var err error
+		if raw, err = json.Marshal(details); err != nil { return err }
+	}
+	_, err := q.ExecContext(ctx, "INSERT INTO audit_log (action, actor_id, subject, ip, details) VALUES ($1, $2, $3, $4, $5)",
+		action, actorID, subject, ip, nullBytes(raw))
+	return err
+}
+
+func nullBytes(b []byte) any {
+	if b == nil { return nil }
+	return string(b)
+}
+
+// List returns the newest entries first, optionally only those of action,
+// older than the entry with id before when before is not zero.
+func (a *AuditLog) List(ctx context.Context, action string, before int64, limit int) ([]*AuditEntry, error) {
+	rows, err := a.db.QueryContext(ctx, `SELECT id, action, actor_id, subject, COALESCE(ip, ''), details, created_at FROM audit_log
+		WHERE ($1 = '' OR action = $1) AND ($2 = 0 OR id < $2) ORDER BY id DESC LIMIT $3`, action, before, limit)
+	if err != nil { return nil, err }
+	defer rows.Close()
+	entries := []*AuditEntry{}
+	for rows.Next() {
+		e := &AuditEntry{}
+		var details []byte
+		if err := rows.Scan(&e.ID, &e.Action, &e.ActorID, &e.Subject, &e.IP, &details, &e.CreatedAt); err != nil { return nil, err }
+		if details != nil { e.Details = details }
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	// ErrRefreshTokenReused reports a refresh token presented a second time,
+	// which means it was stolen; the whole session has been revoked.
+	ErrRefreshTokenReused = errors.New("refresh token reused; session revoked")
+)
+
+// randomToken returns n random bytes encoded for use in URLs and headers.
+func randomToken(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil { panic(err) }
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// hashToken is how refresh tokens are stored: they are long random values,
+// so a plain SHA-256 is enough to make a leaked table useless.
+func hashToken(tok string) string {
+	sum := sha256.Sum256([]byte(tok))
+	return hex.EncodeToString(sum[:])
+}
+
+// TokenPair is what a client gets on login and refresh. ExpiresIn is the
+// lifetime of the access token in seconds.
+type TokenPair struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
+// SessionService keeps login sessions. Each session is a family of refresh
+// tokens: every refresh spends the presented token and issues the next one,
+// and access tokens carry the session id (sid) so that revoking a session
+// invalidates them at once.
+type SessionService struct {
+	db         DB
+	jwt        *JWTManager
+	refreshTTL time.Duration
+	// requireAdminTOTP keeps admins without a second factor from using
+	// their permissions until they enable one.
+	requireAdminTOTP bool
+}
+
+func NewSessionService(db DB, jwt *JWTManager, refreshTTL time.Duration, requireAdminTOTP bool) *SessionService {
+	return &SessionService{db: db, jwt: jwt, refreshTTL: refreshTTL, requireAdminTOTP: requireAdminTOTP}
+}
+
+// Create starts a session for a user who has just authenticated.
+func (s *SessionService) Create(ctx context.Context, u *User) (*TokenPair, error) {
+	sid := randomToken(16)
+	refresh := randomToken(32)
+	err := withTx(ctx, s.db, func(tx *sql.Tx) error {
+		expires := time.Now().Add(s.refreshTTL)
+		if _, err := tx.ExecContext(ctx, "INSERT INTO auth_sessions (id, user_id, expires_at) VALUES ($1, $2, $3)", sid, u.ID, expires); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, "INSERT INTO refresh_tokens (token_hash, session_id, expires_at) VALUES ($1, $2, $3)", hashToken(refresh), sid, expires)
+		return err
+	})
+	if err != nil { return nil, err }
+	return s.pair(u.ID, u.Role, sid, refresh)
+}
+
+// Refresh exchanges a refresh token for a new pair. A token that has
+// already been spent revokes its whole session, cutting off both the thief
+// and the legitimate client, who has to log in again.
+func (s *SessionService) Refresh(ctx context.Context, refresh string) (*TokenPair, error) {
+	var (
+		sid, next string
+		role      string
+		userID    int64
+		reused    bool
+	)
+	err := withTx(ctx, s.db, func(tx *sql.Tx) error {
+		var expiresAt time.Time
+		var usedAt, revokedAt *time.Time
+		err := tx.QueryRowContext(ctx, `SELECT t.session_id, t.expires_at, t.used_at, s.revoked_at, u.id, u.role
+			FROM refresh_tokens t JOIN auth_sessions s ON s.id = t.session_id JOIN users u ON u.id = s.user_id
+			WHERE t.token_hash = $1 AND u.deleted_at IS NULL AND u.disabled_at IS NULL FOR UPDATE OF t, s`, hashToken(refresh)).
+			Scan(&sid, &expiresAt, &usedAt, &revokedAt, &userID, &role)
+		if errors.Is(err, sql.ErrNoRows) { return ErrInvalidRefreshToken }
+		if err != nil { return err }
+		if revokedAt != nil || !expiresAt.After(time.Now()) { return ErrInvalidRefreshToken }
+		if usedAt != nil {
+			reused = true
+			return revokeSession(ctx, tx, sid)
+		}
+		next = randomToken(32)
+		expires := time.Now().Add(s.refreshTTL)
+		if _, err := tx.ExecContext(ctx, "UPDATE refresh_tokens SET used_at = NOW() WHERE token_hash = $1", hashToken(refresh)); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO refresh_tokens (token_hash, session_id, expires_at) VALUES ($1, $2, $3)", hashToken(next), sid, expires); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "UPDATE auth_sessions SET expires_at = $1, last_used_at = NOW() WHERE id = $2", expires, sid)
+		return err
+	})
+	if err != nil { return nil, err }
+	if reused { return nil, ErrRefreshTokenReused }
+	return s.pair(userID, role, sid, next)
+}
+
+func (s *SessionService) pair(userID int64, role, sid, refresh string) (*TokenPair, error) {
+	access, err := s.jwt.GenerateToken(userID, role, sid)
+	if err != nil { return nil, err }
+	return &TokenPair{AccessToken: access, RefreshToken: refresh, TokenType: "Bearer", ExpiresIn: int64(s.jwt.exp / time.Second)}, nil
+}
+
+// SessionOf returns the session a refresh token belongs to and its user.
+// Only a token that could still be refreshed counts: spent, expired and
+// revoked ones give ErrInvalidRefreshToken, so that a stale leaked token
+// cannot end sessions.
+func (s *SessionService) SessionOf(ctx context.Context, refresh string) (sid string, userID int64, err error) {
+	err = s.db.QueryRowContext(ctx, `SELECT t.session_id, s.user_id FROM refresh_tokens t JOIN auth_sessions s ON s.id = t.session_id
+		WHERE t.token_hash = $1 AND t.used_at IS NULL AND t.expires_at > NOW() AND s.revoked_at IS NULL`, hashToken(refresh)).Scan(&sid, &userID)
+	if errors.Is(err, sql.ErrNoRows) { return "", 0, ErrInvalidRefreshToken }
+	return sid, userID, err
+}
+
+// Revoke ends a session: its refresh tokens stop working and its access
+// tokens are rejected by JWTAuthMiddleware.
+func (s *SessionService) Revoke(ctx context.Context, sid string) error {
+	return revokeSession(ctx, s.db, sid)
+}
+
+// RevokeUser ends every session of a user.
+func (s *SessionService) RevokeUser(ctx context.Context, userID int64) error {
+	return revokeUserSessions(ctx, s.db, userID)
+}
+
+func revokeUserSessions(ctx context.Context, q querier, userID int64) error {
+	_, err := q.ExecContext(ctx, "UPDATE auth_sessions SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL", userID)
+	return err
+}
+
+func revokeSession(ctx context.Context, q querier, sid string) error {
+	_, err := q.ExecContext(ctx, "UPDATE auth_sessions SET revoked_at = NOW() WHERE id = $1 AND revoked_at IS NULL", sid)
+	return err
+}
+
+// sessionUser is what JWTAuthMiddleware needs to know about the user of a
+// session on every request.
+type sessionUser struct {
+	Role     string
+	Verified bool
+	// NeedsTOTP is set for admins who must enable a second factor first.
+	NeedsTOTP bool
+	// Scopes limits the permissions of requests made with an API key; it is
+	// nil for sessions.
+	Scopes map[string]bool
+}
+
+// Active returns the user of a session, or nil if the session cannot be
+// used: it is unknown, revoked or expired, or its user has been deleted or
+// disabled.
+func (s *SessionService) Active(ctx context.Context, sid string) (*sessionUser, error) {
+	u := &sessionUser{}
+	var totp bool
+	err := s.db.QueryRowContext(ctx, `SELECT u.role, u.email_verified_at IS NOT NULL, u.totp_enabled_at IS NOT NULL FROM auth_sessions s JOIN users u ON u.id = s.user_id
+		WHERE s.id = $1 AND s.revoked_at IS NULL AND s.expires_at > NOW() AND u.deleted_at IS NULL AND u.disabled_at IS NULL`, sid).
+		Scan(&u.Role, &u.Verified, &totp)
+	if errors.Is(err, sql.ErrNoRows) { return nil, nil }
+	if err != nil { return nil, err }
+	u.NeedsTOTP = s.requireAdminTOTP && u.Role == RoleAdmin && !totp
+	return u, nil
+}
+
+// Purge removes sessions that expired before the given time; revoked
+// sessions are kept until then so their access tokens stay rejected.
+func (s *SessionService) Purge(ctx context.Context, before time.Time) (int64, error) {
+	res, err := s.db.ExecContext(ctx, "DELETE FROM auth_sessions WHERE expires_at < $1", before)
+	if err != nil { return 0, err }
+	return res.RowsAffected()
+}
@@ -4,6 +4,11 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
 )
 
 func migrate(db DB) error {
@@ -29,7 +34,188 @@ func migrate(db DB) error {
 			enabled BOOLEAN NOT NULL DEFAULT TRUE,
 			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
 		)`,
+		`ALTER TABLE posts ADD COLUMN IF NOT EXISTS feed_id INTEGER REFERENCES feeds(id) ON DELETE SET NULL`,
+		`ALTER TABLE posts ADD COLUMN IF NOT EXISTS author TEXT`,
+		`ALTER TABLE posts ADD COLUMN IF NOT EXISTS author_id INTEGER REFERENCES users(id) ON DELETE SET NULL`,
+		`CREATE INDEX IF NOT EXISTS posts_created_idx ON posts (created_at DESC, id DESC)`,
+		`CREATE INDEX IF NOT EXISTS posts_published_idx ON posts ((COALESCE(published_at, created_at)) DESC, id DESC)`,
+		`CREATE INDEX IF NOT EXISTS posts_source_idx ON posts (source)`,
+		`CREATE INDEX IF NOT EXISTS posts_feed_idx ON posts (feed_id)`,
+		`ALTER TABLE posts ADD COLUMN IF NOT EXISTS search_ru tsvector GENERATED ALWAYS AS (
+			setweight(to_tsvector('russian'::regconfig, title), 'A') || setweight(to_tsvector('russian'::regconfig, content), 'B')
+		) STORED`,
+		`ALTER TABLE posts ADD COLUMN IF NOT EXISTS search_en tsvector GENERATED ALWAYS AS (
+			setweight(to_tsvector('english'::regconfig, title), 'A') || setweight(to_tsvector('english'::regconfig, content), 'B')
+		) STORED`,
+		`CREATE INDEX IF NOT EXISTS posts_search_ru_idx ON posts USING GIN (search_ru)`,
+		`CREATE INDEX IF NOT EXISTS posts_search_en_idx ON posts USING GIN (search_en)`,
+		`CREATE TABLE IF NOT EXISTS tags (
+			id SERIAL PRIMARY KEY,
+			slug TEXT NOT NULL UNIQUE,
+			name TEXT NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		)`,
+		`CREATE TABLE IF NOT EXISTS tag_aliases (
+			slug TEXT PRIMARY KEY,
+			tag_id INTEGER NOT NULL REFERENCES tags(id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS post_tags (
+			post_id INTEGER NOT NULL REFERENCES posts(id) ON DELETE CASCADE,
+			tag_id INTEGER NOT NULL REFERENCES tags(id) ON DELETE CASCADE,
+			PRIMARY KEY (post_id, tag_id)
+		)`,
+		`CREATE INDEX IF NOT EXISTS post_tags_tag_idx ON post_tags (tag_id)`,
+		`ALTER TABLE posts ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'published'
+			CHECK (status IN ('draft', 'scheduled', 'published', 'unpublished'))`,
+		`ALTER TABLE posts ADD COLUMN IF NOT EXISTS publish_at TIMESTAMPTZ`,
+		`CREATE INDEX IF NOT EXISTS posts_scheduled_idx ON posts (publish_at) WHERE status = 'scheduled'`,
+		`CREATE TABLE IF NOT EXISTS post_revisions (
+			id SERIAL PRIMARY KEY,
+			post_id INTEGER NOT NULL REFERENCES posts(id) ON DELETE CASCADE,
+			rev INTEGER NOT NULL,
+			title TEXT NOT NULL,
+			content TEXT NOT NULL,
+			editor_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			UNIQUE (post_id, rev)
+		)`,
+		// Posts written before revisions existed start their history at rev 1.
+		`INSERT INTO post_revisions (post_id, rev, title, content, editor_id, created_at)
+			SELECT p.id, 1, p.title, p.content, p.author_id, p.created_at FROM posts p
+			WHERE NOT EXISTS (SELECT 1 FROM post_revisions r WHERE r.post_id = p.id)`,
+		`ALTER TABLE posts ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ`,
+		`ALTER TABLE feeds ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ`,
+		`ALTER TABLE posts ADD COLUMN IF NOT EXISTS version INTEGER NOT NULL DEFAULT 1`,
+		`ALTER TABLE posts ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()`,
+		`ALTER TABLE posts ADD COLUMN IF NOT EXISTS content_format TEXT NOT NULL DEFAULT 'plain'
+			CHECK (content_format IN ('plain', 'markdown', 'html'))`,
+		`ALTER TABLE posts ADD COLUMN IF NOT EXISTS content_html TEXT`,
+		`ALTER TABLE posts ADD COLUMN IF NOT EXISTS excerpt TEXT`,
+		`ALTER TABLE posts ADD COLUMN IF NOT EXISTS content_text TEXT`,
+		`ALTER TABLE posts ADD COLUMN IF NOT EXISTS slug TEXT`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS posts_slug_idx ON posts (slug)`,
+		`ALTER TABLE posts ADD COLUMN IF NOT EXISTS fingerprint BIGINT`,
+		`ALTER TABLE posts ADD COLUMN IF NOT EXISTS cluster_id BIGINT`,
+		`UPDATE posts SET cluster_id = id WHERE cluster_id IS NULL`,
+		`CREATE INDEX IF NOT EXISTS posts_cluster_idx ON posts (cluster_id)`,
+		// Posts without bands are fingerprinted again by backfillPosts.
+		`ALTER TABLE posts ADD COLUMN IF NOT EXISTS fingerprint_bands INTEGER[]`,
+		`CREATE INDEX IF NOT EXISTS posts_fingerprint_bands_idx ON posts USING GIN (fingerprint_bands)`,
+		`CREATE TABLE IF NOT EXISTS stories (
+			id BIGSERIAL PRIMARY KEY,
+			title TEXT NOT NULL,
+			keywords TEXT[] NOT NULL DEFAULT '{}',
+			post_count INTEGER NOT NULL DEFAULT 1,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			last_seen_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		)`,
+		`CREATE INDEX IF NOT EXISTS stories_keywords_idx ON stories USING GIN (keywords)`,
+		`CREATE INDEX IF NOT EXISTS stories_last_seen_idx ON stories (last_seen_at)`,
+		`ALTER TABLE posts ADD COLUMN IF NOT EXISTS keywords TEXT[]`,
+		`UPDATE posts SET keywords = ` + postKeywordsExpr + ` WHERE keywords IS NULL`,
+		`ALTER TABLE posts ADD COLUMN IF NOT EXISTS story_id BIGINT REFERENCES stories(id) ON DELETE SET NULL`,
+		`CREATE INDEX IF NOT EXISTS posts_story_idx ON posts (story_id)`,
+		`CREATE TABLE IF NOT EXISTS post_slug_redirects (
+			slug TEXT PRIMARY KEY,
+			post_id BIGINT NOT NULL REFERENCES posts(id) ON DELETE CASCADE,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		)`,
+		`ALTER TABLE posts ADD COLUMN IF NOT EXISTS word_count INT NOT NULL DEFAULT 0`,
+		`ALTER TABLE posts ADD COLUMN IF NOT EXISTS reading_time INT NOT NULL DEFAULT 0`,
+		`ALTER TABLE post_revisions ADD COLUMN IF NOT EXISTS content_format TEXT NOT NULL DEFAULT 'plain'`,
+		`ALTER TABLE feeds ADD COLUMN IF NOT EXISTS group_name TEXT`,
+		`CREATE TABLE IF NOT EXISTS auth_sessions (
+			id TEXT PRIMARY KEY,
+			user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			last_used_at TIMESTAMPTZ,
+			expires_at TIMESTAMPTZ NOT NULL,
+			revoked_at TIMESTAMPTZ
+		)`,
+		`CREATE INDEX IF NOT EXISTS auth_sessions_user_idx ON auth_sessions (user_id)`,
+		`CREATE INDEX IF NOT EXISTS auth_sessions_expires_idx ON auth_sessions (expires_at)`,
+		`CREATE TABLE IF NOT EXISTS refresh_tokens (
+			token_hash TEXT PRIMARY KEY,
+			session_id TEXT NOT NULL REFERENCES auth_sessions(id) ON DELETE CASCADE,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			expires_at TIMESTAMPTZ NOT NULL,
+			used_at TIMESTAMPTZ
+		)`,
+		`CREATE INDEX IF NOT EXISTS refresh_tokens_session_idx ON refresh_tokens (session_id)`,
+		`CREATE TABLE IF NOT EXISTS roles (
+			name TEXT PRIMARY KEY,
+			description TEXT NOT NULL DEFAULT '',
+			builtin BOOLEAN NOT NULL DEFAULT FALSE,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		)`,
+		`CREATE TABLE IF NOT EXISTS role_permissions (
+			role TEXT NOT NULL REFERENCES roles(name) ON DELETE CASCADE,
+			permission TEXT NOT NULL,
+			PRIMARY KEY (role, permission)
+		)`,
 	}
+	stmts = append(stmts, seedRolesStmts()...)
+	stmts = append(stmts,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS role TEXT REFERENCES roles(name)`,
+		`UPDATE users SET role = CASE WHEN is_admin THEN 'admin' ELSE 'viewer' END WHERE role IS NULL`,
+		`ALTER TABLE users ALTER COLUMN role SET DEFAULT 'viewer'`,
+		`ALTER TABLE users ALTER COLUMN role SET NOT NULL`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS disabled_at TIMESTAMPTZ`,
+		// Users created before verification existed count as verified.
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified_at TIMESTAMPTZ DEFAULT NOW()`,
+		`ALTER TABLE users ALTER COLUMN email_verified_at DROP DEFAULT`,
+		`CREATE TABLE IF NOT EXISTS user_tokens (
+			token_hash TEXT PRIMARY KEY,
+			user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			purpose TEXT NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			expires_at TIMESTAMPTZ NOT NULL,
+			used_at TIMESTAMPTZ
+		)`,
+		`CREATE INDEX IF NOT EXISTS user_tokens_user_idx ON user_tokens (user_id, purpose)`,
+		`CREATE TABLE IF NOT EXISTS login_throttle (
+			key TEXT PRIMARY KEY,
+			failures INTEGER NOT NULL,
+			last_failure_at TIMESTAMPTZ NOT NULL,
+			locked_until TIMESTAMPTZ
+		)`,
+		`CREATE TABLE IF NOT EXISTS audit_log (
+			id BIGSERIAL PRIMARY KEY,
+			action TEXT NOT NULL,
+			actor_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+			subject TEXT NOT NULL,
+			ip TEXT,
+			details JSONB,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		)`,
+		`CREATE INDEX IF NOT EXISTS audit_log_action_idx ON audit_log (action, id)`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_secret TEXT`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_enabled_at TIMESTAMPTZ`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_last_step BIGINT`,
+		`CREATE TABLE IF NOT EXISTS recovery_codes (
+			user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			code_hash TEXT NOT NULL,
+			used_at TIMESTAMPTZ,
+			PRIMARY KEY (user_id, code_hash)
+		)`,
+		`CREATE TABLE IF NOT EXISTS api_keys (
+			id BIGSERIAL PRIMARY KEY,
+			user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			name TEXT NOT NULL,
+			prefix TEXT NOT NULL UNIQUE,
+			key_hash TEXT NOT NULL,
+			scopes TEXT[] NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			expires_at TIMESTAMPTZ,
+			last_used_at TIMESTAMPTZ,
+			revoked_at TIMESTAMPTZ
+		)`,
+		`CREATE INDEX IF NOT EXISTS api_keys_user_idx ON api_keys (user_id)`,
+		`CREATE INDEX IF NOT EXISTS posts_deleted_idx ON posts (deleted_at) WHERE deleted_at IS NOT NULL`,
+		`CREATE INDEX IF NOT EXISTS feeds_deleted_idx ON feeds (deleted_at) WHERE deleted_at IS NOT NULL`,
+		`CREATE INDEX IF NOT EXISTS users_deleted_idx ON users (deleted_at) WHERE deleted_at IS NOT NULL`,
+	)
 	for _, s := range stmts {
 		if _, err := db.Exec(s); err != nil {
 			return fmt.Errorf("migrate: %w", err)
@@ -38,9 +224,46 @@ func migrate(db DB) error {
 	return nil
 }
 
+// backfillPosts computes the derived fields of posts stored before those
+// fields existed, in batches.
+func backfillPosts(ctx context.Context, db DB) error {
+	for {
+		rows, err := db.QueryContext(ctx, `SELECT id, title, content_format, content FROM posts
+			WHERE content_html IS NULL OR excerpt IS NULL OR content_text IS NULL OR fingerprint IS NULL OR fingerprint_bands IS NULL ORDER BY id LIMIT 500`)
+		if err != nil { return err }
+		type pending struct {
+			id                     int64
+			title, format, content string
+		}
+		var batch []pending
+		for rows.Next() {
+			var p pending
+			if err := rows.Scan(&p.id, &p.title, &p.format, &p.content); err != nil { rows.Close(); return err }
+			batch = append(batch, p)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil { return err }
+		if len(batch) == 0 { return nil }
+		for _, p := range batch {
+			d, err := derivePostFields(p.title, p.format, p.content)
+			if err != nil { return fmt.Errorf("post %d: %w", p.id, err) }
+			_, err = db.ExecContext(ctx, `UPDATE posts SET content_html = $1, excerpt = $2, word_count = $3, reading_time = $4,
+				fingerprint = $5, fingerprint_bands = $6, content_text = $7 WHERE id = $8`,
+				d.ContentHTML, d.Excerpt, d.WordCount, d.ReadingTime, d.Fingerprint, pq.Array(simhashBandKeys(d.Fingerprint)), d.Text, p.id)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// ensureDefaultAdmin creates the default admin when no active admin exists,
+// which matches what ensureOtherAdmin protects. An existing account with
+// that email, trashed ones included, is never touched: reviving it would
+// undo a deletion and reset a password behind an admin's back.
 func ensureDefaultAdmin(db DB, cfg Config) error {
 	var exists int
-	if err := db.QueryRowContext(context.Background(), "SELECT COUNT(1) FROM users WHERE is_admin = TRUE").Scan(&exists); err != nil {
+	if err := db.QueryRowContext(context.Background(), "SELECT COUNT(1) FROM users WHERE role = 'admin' AND deleted_at IS NULL AND disabled_at IS NULL").Scan(&exists); err != nil {
 		return err
 	}
 	if exists > 0 {
@@ -54,8 +277,42 @@ func ensureDefaultAdmin(db DB, cfg Config) error {
 	if err != nil {
 		return err
 	}
-	var id int64
-	row := db.QueryRowContext(context.Background(), "INSERT INTO users (email, password_hash, is_admin) VALUES ($1, $2, TRUE) RETURNING id", cfg.DefaultAdmin, hash)
-	if err := row.Scan(&id); err != nil { return err }
+	res, err := db.ExecContext(context.Background(), `INSERT INTO users (email, password_hash, role, is_admin, email_verified_at) VALUES ($1, $2, 'admin', TRUE, NOW())
+		ON CONFLICT (email) DO NOTHING`, cfg.DefaultAdmin, hash)
+	if err != nil { return err }
+	if n, _ := res.RowsAffected(); n == 0 {
+		log.Printf("no active admin, and DEFAULT_ADMIN_EMAIL %s belongs to an existing account; restore or enable an admin, or set another DEFAULT_ADMIN_EMAIL", cfg.DefaultAdmin)
+	}
 	return nil
-}
\ No newline at end of file
+}
+
+// queryBuilder accumulates WHERE conditions and their positional arguments.
+type queryBuilder struct {
+	conds []string
+	args  []any
+}
+
+// arg binds v and returns its placeholder.
+func (q *queryBuilder) arg(v any) string {
+	q.args = append(q.args, v)
+	return "$" + strconv.Itoa(len(q.args))
+}
+
+// where adds a condition, replacing each ? in cond with the next of args.
+func (q *queryBuilder) where(cond string, args ...any) {
+	var b strings.Builder
+	for _, r := range cond {
+		if r == '?' && len(args) > 0 {
+			b.WriteString(q.arg(args[0]))
+			args = args[1:]
+			continue
+		}
+		b.WriteRune(r)
+	}
+	q.conds = append(q.conds, b.String())
+}
+
+func (q *queryBuilder) whereClause() string {
+	if len(q.conds) == 0 { return "" }
+	return " WHERE " + strings.Join(q.conds, " AND ")
+}
@@ -11,6 +11,26 @@ type DB interface {
 	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
 	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
 	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+// querier is the part of DB shared with *sql.Tx, for helpers that may run
+// inside or outside a transaction.
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// withTx runs fn in a transaction, committing if it returns nil.
+func withTx(ctx context.Context, db DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil { return err }
+	if err := fn(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
 }
 
 type DBAdapter struct {
@@ -37,4 +57,8 @@ func (d *DBAdapter) QueryContext(ctx context.Context, query string, args ...any)
 
 func (d *DBAdapter) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
 	return d.inner.QueryRowContext(ctx, query, args...)
-}
\ No newline at end of file
+}
+
+func (d *DBAdapter) BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error) {
+	return d.inner.BeginTx(ctx, opts)
+}
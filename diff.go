@@ -0,0 +1,95 @@
+package main
+
+import "strings"
+
+// diffOp is one run of a diff: text that is equal in both versions, or was
+// inserted or deleted going from the old version to the new one.
+type diffOp struct {
+	Op   string `json:"op"`
+	Text string `json:"text"`
+}
+
+// maxDiffCells bounds the LCS table; larger inputs degrade to a single
+// delete+insert pair instead of an exact diff.
+const maxDiffCells = 4_000_000
+
+// diffLines diffs two texts line by line.
+func diffLines(a, b string) []diffOp {
+	return diffTokens(strings.SplitAfter(a, "\n"), strings.SplitAfter(b, "\n"))
+}
+
+// diffWords diffs two texts word by word, keeping the whitespace.
+func diffWords(a, b string) []diffOp {
+	return diffTokens(splitWords(a), splitWords(b))
+}
+
+func splitWords(s string) []string {
+	var out []string
+	start := 0
+	for i, r := range s {
+		if r == ' ' || r == '\t' || r == '\n' {
+			out = append(out, s[start:i+1])
+			start = i + 1
+		}
+	}
+	if start < len(s) { out = append(out, s[start:]) }
+	return out
+}
+
+func diffTokens(a, b []string) []diffOp {
+	var ops []diffOp
+	emit := func(op, text string) {
+		if text == "" { return }
+		if n := len(ops); n > 0 && ops[n-1].Op == op {
+			ops[n-1].Text += text
+			return
+		}
+		ops = append(ops, diffOp{Op: op, Text: text})
+	}
+
+	// Common prefix and suffix are cheap to strip and usually make up most of an edit.
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] { pre++ }
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] { suf++ }
+	emit("equal", strings.Join(a[:pre], ""))
+	ma, mb := a[pre:len(a)-suf], b[pre:len(b)-suf]
+
+	if len(ma)*len(mb) > maxDiffCells {
+		emit("delete", strings.Join(ma, ""))
+		emit("insert", strings.Join(mb, ""))
+	} else {
+		// lcs[i][j] is the LCS length of ma[i:] and mb[j:].
+		lcs := make([][]int, len(ma)+1)
+		for i := range lcs { lcs[i] = make([]int, len(mb)+1) }
+		for i := len(ma) - 1; i >= 0; i-- {
+			for j := len(mb) - 1; j >= 0; j-- {
+				if ma[i] == mb[j] {
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				} else {
+					lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+				}
+			}
+		}
+		i, j := 0, 0
+		for i < len(ma) && j < len(mb) {
+			switch {
+			case ma[i] == mb[j]:
+				emit("equal", ma[i])
+				i++
+				j++
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				emit("delete", ma[i])
+				i++
+			default:
+				emit("insert", mb[j])
+				j++
+			}
+		}
+		emit("delete", strings.Join(ma[i:], ""))
+		emit("insert", strings.Join(mb[j:], ""))
+	}
+	emit("equal", strings.Join(a[len(a)-suf:], ""))
+	if ops == nil { ops = []diffOp{} }
+	return ops
+}
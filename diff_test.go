@@ -0,0 +1,74 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDiffTokens(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b []string
+		want []diffOp
+	}{
+		{"both empty", nil, nil, []diffOp{}},
+		{"equal", []string{"a ", "b"}, []string{"a ", "b"}, []diffOp{{"equal", "a b"}}},
+		{"all inserted", nil, []string{"a ", "b"}, []diffOp{{"insert", "a b"}}},
+		{"all deleted", []string{"a ", "b"}, nil, []diffOp{{"delete", "a b"}}},
+		{"word replaced", []string{"a ", "b ", "c"}, []string{"a ", "x ", "c"},
+			[]diffOp{{"equal", "a "}, {"delete", "b "}, {"insert", "x "}, {"equal", "c"}}},
+		{"appended", []string{"a ", "b"}, []string{"a ", "b", " c"},
+			[]diffOp{{"equal", "a b"}, {"insert", " c"}}},
+		{"middle removed", []string{"a ", "b ", "c ", "d"}, []string{"a ", "d"},
+			[]diffOp{{"equal", "a "}, {"delete", "b c "}, {"equal", "d"}}},
+		{"interleaved", []string{"x", "a", "y", "b"}, []string{"a", "z", "b"},
+			[]diffOp{{"delete", "x"}, {"equal", "a"}, {"delete", "y"}, {"insert", "z"}, {"equal", "b"}}},
+	}
+	for _, tt := range tests {
+		if got := diffTokens(tt.a, tt.b); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: diffTokens = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestDiffTokensReconstructs checks that every diff turns back into both
+// of its inputs and never has two runs of the same kind in a row.
+func TestDiffTokensReconstructs(t *testing.T) {
+	pairs := [][2]string{
+		{"the quick brown fox", "the slow brown dog"},
+		{"one\ntwo\nthree\n", "zero\none\nthree\nfour\n"},
+		{"a b a b a b", "b a b a"},
+		{"", "new text"},
+		{"Курс тенге вырос", "Курс тенге снова вырос"},
+	}
+	for _, p := range pairs {
+		for _, ops := range [][]diffOp{diffWords(p[0], p[1]), diffLines(p[0], p[1])} {
+			var a, b strings.Builder
+			for i, op := range ops {
+				if i > 0 && ops[i-1].Op == op.Op { t.Errorf("%q -> %q: consecutive %s runs in %v", p[0], p[1], op.Op, ops) }
+				if op.Op != "insert" { a.WriteString(op.Text) }
+				if op.Op != "delete" { b.WriteString(op.Text) }
+			}
+			if a.String() != p[0] || b.String() != p[1] {
+				t.Errorf("%q -> %q: diff %v rebuilds %q -> %q", p[0], p[1], ops, a.String(), b.String())
+			}
+		}
+	}
+}
+
+func TestDiffTokensTooLarge(t *testing.T) {
+	a := make([]string, 3000)
+	b := make([]string, 3000)
+	for i := range a {
+		a[i] = "a" + strings.Repeat("x", i%7) + " "
+		b[i] = "b" + strings.Repeat("y", i%5) + " "
+	}
+	b[len(b)-1] = a[len(a)-1]
+	ops := diffTokens(append([]string{"same "}, a...), append([]string{"same "}, b...))
+	want := []string{"equal", "delete", "insert", "equal"}
+	if len(ops) != len(want) { t.Fatalf("got %d runs, want %d", len(ops), len(want)) }
+	for i, op := range ops {
+		if op.Op != want[i] { t.Errorf("run %d is %s, want %s", i, op.Op, want[i]) }
+	}
+}
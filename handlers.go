@@ -2,8 +2,15 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 )
@@ -12,11 +19,14 @@ import (
 
 type AuthHandler struct {
 	users      *UserService
+	sessions   *SessionService
 	jwtManager *JWTManager
+	throttle   *LoginThrottle
+	twoFactor  *TwoFactorService
 }
 
-func NewAuthHandler(users *UserService, jwt *JWTManager) *AuthHandler {
-	return &AuthHandler{users: users, jwtManager: jwt}
+func NewAuthHandler(users *UserService, sessions *SessionService, jwt *JWTManager, throttle *LoginThrottle, twoFactor *TwoFactorService) *AuthHandler {
+	return &AuthHandler{users: users, sessions: sessions, jwtManager: jwt, throttle: throttle, twoFactor: twoFactor}
 }
 
 type loginRequest struct {
@@ -24,10 +34,47 @@ type loginRequest struct {
 	Password string `json:"password"`
 }
 
+// loginResponse keeps token, the access token under its old name, for
+// clients written before refresh tokens.
 type loginResponse struct {
 	Token string `json:"token"`
+	*TokenPair
 }
 
+// loginChallengeResponse asks for the second step of a login.
+type loginChallengeResponse struct {
+	TwoFactorRequired bool   `json:"two_factor_required"`
+	ChallengeToken    string `json:"challenge_token"`
+	ExpiresIn         int64  `json:"expires_in"`
+}
+
+// throttled reserves a login attempt and answers 429 when the client has to
+// wait before trying again.
+func (h *AuthHandler) throttled(w http.ResponseWriter, r *http.Request, account, ip string) bool {
+	wait, err := h.throttle.Attempt(r.Context(), account, ip)
+	if err != nil { writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()}); return true }
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		writeJSON(w, http.StatusTooManyRequests, map[string]string{"error": "too many login attempts"})
+		return true
+	}
+	return false
+}
+
+// startSession ends a successful login: it forgets the failed attempts of
+// the account and hands out tokens.
+func (h *AuthHandler) startSession(w http.ResponseWriter, r *http.Request, u *User, account, ip string) {
+	if err := h.throttle.Succeeded(r.Context(), account, ip); err != nil { writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()}); return }
+	pair, err := h.sessions.Create(r.Context(), u)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to issue token"})
+		return
+	}
+	writeJSON(w, http.StatusOK, loginResponse{Token: pair.AccessToken, TokenPair: pair})
+}
+
+// HandleLogin checks a password. Users with a second factor get a challenge
+// token for HandleLoginTwoFactor instead of a session.
 func (h *AuthHandler) HandleLogin(w http.ResponseWriter, r *http.Request) {
 	var req loginRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Email == "" || req.Password == "" {
@@ -35,23 +82,444 @@ func (h *AuthHandler) HandleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	u, err := h.users.GetByEmail(r.Context(), req.Email)
-	if err != nil || !h.users.passwordHasher.VerifyPassword(u.PasswordHash, req.Password) {
+	if err != nil && !errors.Is(err, ErrNotFound) { writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()}); return }
+	account, ip := accountKey(u, req.Email), clientIP(r)
+	if h.throttled(w, r, account, ip) { return }
+	// Unknown users are checked against a dummy hash so that both cases take
+	// as long.
+	hash := h.users.passwordHasher.DummyHash()
+	if u != nil { hash = u.PasswordHash }
+	if !h.users.passwordHasher.VerifyPassword(hash, req.Password) || u == nil {
 		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid credentials"})
 		return
 	}
-	tok, err := h.jwtManager.GenerateToken(u.ID, u.IsAdmin)
-	if err != nil {
-		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to issue token"})
+	if u.DisabledAt != nil {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "account disabled"})
+		return
+	}
+	// Failures are only forgotten after the second factor, so that knowing
+	// the password does not buy unlimited guesses at the code.
+	if u.TOTPEnabledAt != nil {
+		challenge, err := h.twoFactor.Challenge(r.Context(), u.ID)
+		if err != nil { writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()}); return }
+		writeJSON(w, http.StatusOK, loginChallengeResponse{TwoFactorRequired: true, ChallengeToken: challenge, ExpiresIn: int64(loginChallengeTTL.Seconds())})
+		return
+	}
+	h.startSession(w, r, u, account, ip)
+}
+
+type loginTwoFactorRequest struct {
+	ChallengeToken string `json:"challenge_token"`
+	// Code is a code from the authenticator app or a recovery code.
+	Code string `json:"code"`
+}
+
+// HandleLoginTwoFactor completes a login with the second factor. Wrong codes
+// count as failed logins.
+func (h *AuthHandler) HandleLoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var req loginTwoFactorRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ChallengeToken == "" || req.Code == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		return
+	}
+	u, err := h.twoFactor.ChallengeUser(r.Context(), req.ChallengeToken)
+	if errors.Is(err, ErrInvalidUserToken) || errors.Is(err, ErrNotFound) {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid or expired challenge"})
+		return
+	}
+	if err != nil { writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()}); return }
+	account, ip := accountKey(u, ""), clientIP(r)
+	if h.throttled(w, r, account, ip) { return }
+	err = h.twoFactor.Verify(r.Context(), req.ChallengeToken, u, req.Code, ip)
+	if errors.Is(err, ErrInvalidOTP) {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, ErrInvalidUserToken) || errors.Is(err, ErrTOTPNotEnabled) {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid or expired challenge"})
+		return
+	}
+	if err != nil { writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()}); return }
+	if u.DisabledAt != nil {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "account disabled"})
+		return
+	}
+	h.startSession(w, r, u, account, ip)
+}
+
+// HandleJWKS publishes the public keys access tokens are signed with, so
+// other services can verify them. It is empty when signing with a secret.
+func (h *AuthHandler) HandleJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.Header().Set("Content-Type", "application/jwk-set+json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(h.jwtManager.JWKS())
+}
+
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// HandleRefresh trades a refresh token for a new access and refresh token.
+func (h *AuthHandler) HandleRefresh(w http.ResponseWriter, r *http.Request) {
+	var req refreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		return
+	}
+	pair, err := h.sessions.Refresh(r.Context(), req.RefreshToken)
+	if errors.Is(err, ErrInvalidRefreshToken) || errors.Is(err, ErrRefreshTokenReused) {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return
+	}
+	if err != nil { writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()}); return }
+	writeJSON(w, http.StatusOK, pair)
+}
+
+type logoutRequest struct {
+	RefreshToken string `json:"refresh_token"`
+	// All ends every session of the user, not just the current one.
+	All bool `json:"all"`
+}
+
+// HandleLogout revokes the session identified by the refresh token in the
+// body or, without one, by the bearer access token.
+func (h *AuthHandler) HandleLogout(w http.ResponseWriter, r *http.Request) {
+	var req logoutRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		return
+	}
+	var sid string
+	var userID int64
+	if req.RefreshToken != "" {
+		var err error
+		sid, userID, err = h.sessions.SessionOf(r.Context(), req.RefreshToken)
+		if errors.Is(err, ErrInvalidRefreshToken) { writeJSON(w, http.StatusUnauthorized, map[string]string{"error": err.Error()}); return }
+		if err != nil { writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()}); return }
+	} else {
+		auth := r.Header.Get("Authorization")
+		claims, err := h.jwtManager.ParseToken(strings.TrimPrefix(auth, "Bearer "))
+		if !strings.HasPrefix(auth, "Bearer ") || err != nil {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "refresh_token or bearer token required"})
+			return
+		}
+		sid, _ = claims["sid"].(string)
+		idF, _ := claims["sub"].(float64)
+		userID = int64(idF)
+		// The access token outlives a revoked session, but must not be able
+		// to log out again, let alone revoke the user's other sessions.
+		active, err := h.sessions.Active(r.Context(), sid)
+		if err != nil { writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()}); return }
+		if active == nil { writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "session revoked or expired"}); return }
+	}
+	var err error
+	if req.All {
+		err = h.sessions.RevokeUser(r.Context(), userID)
+	} else {
+		err = h.sessions.Revoke(r.Context(), sid)
+	}
+	if err != nil { writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()}); return }
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Accounts
+
+type AccountHandler struct {
+	accounts *AccountService
+	users    *UserService
+	sessions *SessionService
+}
+
+func NewAccountHandler(accounts *AccountService, users *UserService, sessions *SessionService) *AccountHandler {
+	return &AccountHandler{accounts: accounts, users: users, sessions: sessions}
+}
+
+type registerRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+// HandleRegister creates an account for anyone when registration is open.
+// The account has no permissions until its email is verified.
+func (h *AccountHandler) HandleRegister(w http.ResponseWriter, r *http.Request) {
+	var req registerRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Email == "" || req.Password == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		return
+	}
+	u, err := h.accounts.Register(r.Context(), req.Email, req.Password)
+	if errors.Is(err, ErrRegistrationClosed) { writeJSON(w, http.StatusForbidden, map[string]string{"error": err.Error()}); return }
+	if err != nil { writeServiceError(w, err); return }
+	writeJSON(w, http.StatusCreated, u)
+}
+
+type verifyEmailRequest struct {
+	Token string `json:"token"`
+}
+
+func (h *AccountHandler) HandleVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var req verifyEmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		return
+	}
+	u, err := h.accounts.VerifyEmail(r.Context(), req.Token)
+	if err != nil { writeServiceError(w, err); return }
+	writeJSON(w, http.StatusOK, u)
+}
+
+// HandleResendVerification mails the logged-in user a new verification link.
+func (h *AccountHandler) HandleResendVerification(w http.ResponseWriter, r *http.Request) {
+	u, err := h.users.GetByID(r.Context(), *currentUserID(r))
+	if err != nil { writeServiceError(w, err); return }
+	if err := h.accounts.SendVerification(r.Context(), u); err != nil {
+		if errors.Is(err, ErrAlreadyVerified) { writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()}); return }
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+type forgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+// HandleForgotPassword mails a reset link in the background. It always
+// answers 202, whether or not the email belongs to an account.
+func (h *AccountHandler) HandleForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var req forgotPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Email == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		return
+	}
+	h.accounts.RequestPasswordReset(req.Email)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+type passwordResetRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+func (h *AccountHandler) HandleResetPassword(w http.ResponseWriter, r *http.Request) {
+	var req passwordResetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" || req.Password == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		return
+	}
+	if _, err := h.accounts.ResetPassword(r.Context(), req.Token, req.Password); err != nil { writeServiceError(w, err); return }
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type changePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// HandleChangePassword sets a new password for the logged-in user. Every
+// session, the current one included, ends; the response carries tokens for
+// a fresh session so the caller stays logged in.
+func (h *AccountHandler) HandleChangePassword(w http.ResponseWriter, r *http.Request) {
+	var req changePasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.CurrentPassword == "" || req.NewPassword == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		return
+	}
+	id := *currentUserID(r)
+	err := h.accounts.ChangePassword(r.Context(), id, req.CurrentPassword, req.NewPassword)
+	if errors.Is(err, ErrWrongPassword) { writeJSON(w, http.StatusForbidden, map[string]string{"error": err.Error()}); return }
+	if err != nil { writeServiceError(w, err); return }
+	u, err := h.users.GetByID(r.Context(), id)
+	if err != nil { writeServiceError(w, err); return }
+	pair, err := h.sessions.Create(r.Context(), u)
+	if err != nil { writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()}); return }
+	writeJSON(w, http.StatusOK, pair)
+}
+
+// Two-factor authentication
+
+type TwoFactorHandler struct {
+	twoFactor *TwoFactorService
+	users     *UserService
+	// requireAdmin refuses to let admins turn their second factor off.
+	requireAdmin bool
+}
+
+func NewTwoFactorHandler(twoFactor *TwoFactorService, users *UserService, requireAdmin bool) *TwoFactorHandler {
+	return &TwoFactorHandler{twoFactor: twoFactor, users: users, requireAdmin: requireAdmin}
+}
+
+type twoFactorStatus struct {
+	Enabled           bool       `json:"enabled"`
+	EnabledAt         *time.Time `json:"enabled_at,omitempty"`
+	RecoveryCodesLeft int        `json:"recovery_codes_left"`
+	Required          bool       `json:"required"`
+}
+
+func (h *TwoFactorHandler) HandleStatus(w http.ResponseWriter, r *http.Request) {
+	u, err := h.users.GetByID(r.Context(), *currentUserID(r))
+	if err != nil { writeServiceError(w, err); return }
+	st := twoFactorStatus{Enabled: u.TOTPEnabledAt != nil, EnabledAt: u.TOTPEnabledAt, Required: h.requireAdmin && u.Role == RoleAdmin}
+	if st.Enabled {
+		if st.RecoveryCodesLeft, err = h.twoFactor.RecoveryCodesLeft(r.Context(), u.ID); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, st)
+}
+
+// HandleSetup returns a new secret to add to an authenticator app.
+func (h *TwoFactorHandler) HandleSetup(w http.ResponseWriter, r *http.Request) {
+	setup, err := h.twoFactor.Setup(r.Context(), *currentUserID(r))
+	if err != nil { writeServiceError(w, err); return }
+	writeJSON(w, http.StatusOK, setup)
+}
+
+type otpRequest struct {
+	Code string `json:"code"`
+}
+
+type recoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// HandleEnable confirms the secret from HandleSetup with a code and returns
+// recovery codes, which are not shown again.
+func (h *TwoFactorHandler) HandleEnable(w http.ResponseWriter, r *http.Request) {
+	var req otpRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		return
+	}
+	codes, err := h.twoFactor.Enable(r.Context(), *currentUserID(r), req.Code)
+	if err != nil { writeServiceError(w, err); return }
+	writeJSON(w, http.StatusOK, recoveryCodesResponse{RecoveryCodes: codes})
+}
+
+type disableTwoFactorRequest struct {
+	Password string `json:"password"`
+}
+
+// HandleDisable turns the second factor off after checking the password.
+func (h *TwoFactorHandler) HandleDisable(w http.ResponseWriter, r *http.Request) {
+	var req disableTwoFactorRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Password == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		return
+	}
+	id := *currentUserID(r)
+	u, err := h.users.GetByID(r.Context(), id)
+	if err != nil { writeServiceError(w, err); return }
+	if !h.users.passwordHasher.VerifyPassword(u.PasswordHash, req.Password) {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": ErrWrongPassword.Error()})
+		return
+	}
+	if h.requireAdmin && u.Role == RoleAdmin {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "admins must keep two-factor authentication enabled"})
+		return
+	}
+	if err := h.twoFactor.Disable(r.Context(), id, id); err != nil { writeServiceError(w, err); return }
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleRecoveryCodes replaces the recovery codes; a current code from the
+// authenticator is required.
+func (h *TwoFactorHandler) HandleRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	var req otpRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		return
+	}
+	codes, err := h.twoFactor.RegenerateRecoveryCodes(r.Context(), *currentUserID(r), req.Code)
+	if err != nil { writeServiceError(w, err); return }
+	writeJSON(w, http.StatusOK, recoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// API keys
+
+type APIKeyHandler struct {
+	keys  *APIKeyService
+	users *UserService
+	roles *RoleService
+}
+
+func NewAPIKeyHandler(keys *APIKeyService, users *UserService, roles *RoleService) *APIKeyHandler {
+	return &APIKeyHandler{keys: keys, users: users, roles: roles}
+}
+
+func (h *APIKeyHandler) HandleList(w http.ResponseWriter, r *http.Request) {
+	keys, err := h.keys.List(r.Context(), *currentUserID(r))
+	if err != nil { writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()}); return }
+	writeJSON(w, http.StatusOK, keys)
+}
+
+type createAPIKeyRequest struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+type createAPIKeyResponse struct {
+	*APIKey
+	// Key is the secret itself; it cannot be retrieved again.
+	Key string `json:"key"`
+}
+
+// HandleCreate issues a key whose scopes are permissions the caller has.
+func (h *APIKeyHandler) HandleCreate(w http.ResponseWriter, r *http.Request) {
+	var req createAPIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request"})
 		return
 	}
-	writeJSON(w, http.StatusOK, loginResponse{Token: tok})
+	id := *currentUserID(r)
+	u, err := h.users.GetByID(r.Context(), id)
+	if err != nil { writeServiceError(w, err); return }
+	have, err := h.roles.Permissions(r.Context(), u.Role)
+	if err != nil { writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()}); return }
+	for _, sc := range req.Scopes {
+		if !have[strings.TrimSpace(sc)] {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "scope " + sc + " is not a permission you have"})
+			return
+		}
+	}
+	k, key, err := h.keys.Create(r.Context(), id, req.Name, req.Scopes, req.ExpiresAt)
+	if err != nil { writeServiceError(w, err); return }
+	writeJSON(w, http.StatusCreated, createAPIKeyResponse{APIKey: k, Key: key})
+}
+
+func (h *APIKeyHandler) HandleRevoke(w http.ResponseWriter, r *http.Request) {
+	keyID, _ := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err := h.keys.Revoke(r.Context(), *currentUserID(r), keyID); err != nil { writeServiceError(w, err); return }
+	w.WriteHeader(http.StatusNoContent)
 }
 
 // Users
 
-type UserHandler struct { users *UserService }
+type UserHandler struct {
+	users     *UserService
+	roles     *RoleService
+	twoFactor *TwoFactorService
+}
+
+func NewUserHandler(s *UserService, roles *RoleService, twoFactor *TwoFactorService) *UserHandler {
+	return &UserHandler{users: s, roles: roles, twoFactor: twoFactor}
+}
 
-func NewUserHandler(s *UserService) *UserHandler { return &UserHandler{users: s} }
+// grantable checks that the caller holds every permission of role, so users
+// managers cannot hand out, or take away, more than they have themselves.
+func (h *UserHandler) grantable(w http.ResponseWriter, r *http.Request, role string) bool {
+	rl, err := h.roles.Get(r.Context(), role)
+	if errors.Is(err, ErrNotFound) { writeJSON(w, http.StatusBadRequest, map[string]string{"error": "unknown role " + role}); return false }
+	if err != nil { writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()}); return false }
+	if !hasPermissions(r, rl.Permissions) {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "role " + role + " has permissions you do not have"})
+		return false
+	}
+	return true
+}
 
 func (h *UserHandler) HandleList(w http.ResponseWriter, r *http.Request) {
 	users, err := h.users.List(r.Context())
@@ -63,6 +531,8 @@ func (h *UserHandler) HandleList(w http.ResponseWriter, r *http.Request) {
 type createUserRequest struct {
 	Email    string `json:"email"`
 	Password string `json:"password"`
+	// Role defaults to viewer, or admin when the legacy IsAdmin is set.
+	Role     string `json:"role"`
 	IsAdmin  bool   `json:"is_admin"`
 }
 
@@ -72,75 +542,686 @@ func (h *UserHandler) HandleCreate(w http.ResponseWriter, r *http.Request) {
 		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request"})
 		return
 	}
-	u, err := h.users.Create(r.Context(), req.Email, req.Password, req.IsAdmin)
-	if err != nil { writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()}); return }
+	if req.Role == "" {
+		req.Role = RoleViewer
+		if req.IsAdmin { req.Role = RoleAdmin }
+	}
+	if !h.grantable(w, r, req.Role) { return }
+	u, err := h.users.Create(r.Context(), req.Email, req.Password, req.Role)
+	if err != nil { writeServiceError(w, err); return }
 	u.PasswordHash = ""
 	writeJSON(w, http.StatusCreated, u)
 }
 
+type setRoleRequest struct {
+	Role string `json:"role"`
+}
+
+// HandleSetRole changes the role of a user. The caller must hold every
+// permission of both the current and the new role.
+func (h *UserHandler) HandleSetRole(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	var req setRoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Role == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		return
+	}
+	if uid := currentUserID(r); uid != nil && *uid == id {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "cannot change your own role"})
+		return
+	}
+	if _, ok := h.manageable(w, r, id); !ok || !h.grantable(w, r, req.Role) { return }
+	u, err := h.users.Update(r.Context(), id, UserUpdate{Role: &req.Role})
+	if err != nil { writeServiceError(w, err); return }
+	writeJSON(w, http.StatusOK, u)
+}
+
+// manageable loads a user the caller is about to change; like grantable it
+// refuses users whose role has permissions the caller lacks.
+func (h *UserHandler) manageable(w http.ResponseWriter, r *http.Request, id int64) (*User, bool) {
+	u, err := h.users.GetByID(r.Context(), id)
+	if err != nil { writeServiceError(w, err); return nil, false }
+	if !h.grantable(w, r, u.Role) { return nil, false }
+	return u, true
+}
+
+func (h *UserHandler) HandleGet(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	u, err := h.users.GetByID(r.Context(), id)
+	if err != nil { writeServiceError(w, err); return }
+	writeJSON(w, http.StatusOK, u)
+}
+
+type updateUserRequest struct {
+	Email    *string `json:"email"`
+	Role     *string `json:"role"`
+	Disabled *bool   `json:"disabled"`
+}
+
+// HandleUpdate changes the email, role or disabled state of a user.
+func (h *UserHandler) HandleUpdate(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	var req updateUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.Role != nil && *req.Role == "") {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		return
+	}
+	if uid := currentUserID(r); uid != nil && *uid == id && (req.Disabled != nil && *req.Disabled || req.Role != nil) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "cannot disable yourself or change your own role"})
+		return
+	}
+	if _, ok := h.manageable(w, r, id); !ok { return }
+	if req.Role != nil && !h.grantable(w, r, *req.Role) { return }
+	u, err := h.users.Update(r.Context(), id, UserUpdate{Email: req.Email, Role: req.Role, Disabled: req.Disabled})
+	if err != nil { writeServiceError(w, err); return }
+	writeJSON(w, http.StatusOK, u)
+}
+
+type resetPasswordRequest struct {
+	Password string `json:"password"`
+}
+
+type resetPasswordResponse struct {
+	// Password is only returned when it was generated.
+	Password string `json:"password,omitempty"`
+}
+
+// HandleResetPassword sets a new password for a user, generating one when
+// the body has none, and logs them out everywhere.
+func (h *UserHandler) HandleResetPassword(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	var req resetPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		return
+	}
+	if _, ok := h.manageable(w, r, id); !ok { return }
+	var resp resetPasswordResponse
+	if req.Password == "" {
+		req.Password = randomToken(12)
+		resp.Password = req.Password
+	}
+	if err := h.users.SetPassword(r.Context(), id, req.Password); err != nil { writeServiceError(w, err); return }
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// HandleResetTwoFactor turns off the second factor of a user who lost their
+// authenticator and recovery codes.
+func (h *UserHandler) HandleResetTwoFactor(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if _, ok := h.manageable(w, r, id); !ok { return }
+	if err := h.twoFactor.Disable(r.Context(), id, *currentUserID(r)); err != nil { writeServiceError(w, err); return }
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Security
+
+type SecurityHandler struct {
+	throttle *LoginThrottle
+	audit    *AuditLog
+	users    *UserService
+}
+
+func NewSecurityHandler(throttle *LoginThrottle, audit *AuditLog, users *UserService) *SecurityHandler {
+	return &SecurityHandler{throttle: throttle, audit: audit, users: users}
+}
+
+// HandleAuditLog lists audit entries, newest first; ?before=<id> pages back.
+func (h *SecurityHandler) HandleAuditLog(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit := 100
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > 500 { writeJSON(w, http.StatusBadRequest, map[string]string{"error": "limit must be between 1 and 500"}); return }
+		limit = n
+	}
+	var before int64
+	if s := q.Get("before"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n < 1 { writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid before"}); return }
+		before = n
+	}
+	entries, err := h.audit.List(r.Context(), q.Get("action"), before, limit)
+	if err != nil { writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()}); return }
+	writeJSON(w, http.StatusOK, entries)
+}
+
+func (h *SecurityHandler) HandleLocks(w http.ResponseWriter, r *http.Request) {
+	locks, err := h.throttle.Locks(r.Context())
+	if err != nil { writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()}); return }
+	writeJSON(w, http.StatusOK, locks)
+}
+
+// HandleUnlock clears a throttled key such as ip:203.0.113.7.
+func (h *SecurityHandler) HandleUnlock(w http.ResponseWriter, r *http.Request) {
+	if err := h.throttle.Unlock(r.Context(), chi.URLParam(r, "key"), *currentUserID(r), clientIP(r)); err != nil { writeServiceError(w, err); return }
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleUnlockUser lets a user log in again right away after a lockout.
+func (h *SecurityHandler) HandleUnlockUser(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	u, err := h.users.GetByID(r.Context(), id)
+	if err != nil { writeServiceError(w, err); return }
+	err = h.throttle.Unlock(r.Context(), accountKey(u, ""), *currentUserID(r), clientIP(r))
+	if err != nil && !errors.Is(err, ErrNotFound) { writeServiceError(w, err); return }
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Roles
+
+type RoleHandler struct { roles *RoleService }
+
+func NewRoleHandler(s *RoleService) *RoleHandler { return &RoleHandler{roles: s} }
+
+func (h *RoleHandler) HandleList(w http.ResponseWriter, r *http.Request) {
+	roles, err := h.roles.List(r.Context())
+	if err != nil { writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()}); return }
+	writeJSON(w, http.StatusOK, roles)
+}
+
+func (h *RoleHandler) HandleGet(w http.ResponseWriter, r *http.Request) {
+	role, err := h.roles.Get(r.Context(), chi.URLParam(r, "name"))
+	if err != nil { writeServiceError(w, err); return }
+	writeJSON(w, http.StatusOK, role)
+}
+
+// HandlePermissions lists every permission a role can be given.
+func (h *RoleHandler) HandlePermissions(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, allPermissions)
+}
+
+type roleRequest struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions"`
+}
+
+func (h *RoleHandler) decode(w http.ResponseWriter, r *http.Request) (roleRequest, bool) {
+	var req roleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		return req, false
+	}
+	if !hasPermissions(r, req.Permissions) {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "cannot grant permissions you do not have"})
+		return req, false
+	}
+	return req, true
+}
+
+func (h *RoleHandler) HandleCreate(w http.ResponseWriter, r *http.Request) {
+	req, ok := h.decode(w, r)
+	if !ok { return }
+	role, err := h.roles.Create(r.Context(), req.Name, req.Description, req.Permissions)
+	if err != nil { writeServiceError(w, err); return }
+	writeJSON(w, http.StatusCreated, role)
+}
+
+func (h *RoleHandler) HandleUpdate(w http.ResponseWriter, r *http.Request) {
+	req, ok := h.decode(w, r)
+	if !ok { return }
+	role, err := h.roles.Update(r.Context(), chi.URLParam(r, "name"), req.Description, req.Permissions)
+	if err != nil { writeServiceError(w, err); return }
+	writeJSON(w, http.StatusOK, role)
+}
+
+func (h *RoleHandler) HandleDelete(w http.ResponseWriter, r *http.Request) {
+	if err := h.roles.Delete(r.Context(), chi.URLParam(r, "name")); err != nil { writeServiceError(w, err); return }
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *UserHandler) HandleDelete(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if uid := currentUserID(r); uid != nil && *uid == id {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "cannot delete yourself"})
+		return
+	}
+	if _, ok := h.manageable(w, r, id); !ok { return }
+	if err := h.users.Delete(r.Context(), id); err != nil { writeServiceError(w, err); return }
+	writeJSON(w, http.StatusOK, map[string]bool{"deleted": true})
+}
+
+func (h *UserHandler) HandleTrash(w http.ResponseWriter, r *http.Request) {
+	users, err := h.users.ListDeleted(r.Context())
+	if err != nil { writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()}); return }
+	writeJSON(w, http.StatusOK, users)
+}
+
+func (h *UserHandler) HandleRestore(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	u, err := h.users.GetDeleted(r.Context(), id)
+	if err != nil { writeServiceError(w, err); return }
+	if !h.grantable(w, r, u.Role) { return }
+	if err := h.users.Restore(r.Context(), id); err != nil { writeServiceError(w, err); return }
+	writeJSON(w, http.StatusOK, map[string]bool{"restored": true})
+}
+
 // Posts
 
-type PostHandler struct { posts *PostService }
+type PostHandler struct {
+	posts *PostService
+	// requireIfMatch rejects unconditional writes with 428.
+	requireIfMatch bool
+}
+
+func NewPostHandler(s *PostService, requireIfMatch bool) *PostHandler {
+	return &PostHandler{posts: s, requireIfMatch: requireIfMatch}
+}
+
+// authorize lets holders of posts:write change any post and holders of
+// posts:write_own only the posts they created.
+func (h *PostHandler) authorize(w http.ResponseWriter, r *http.Request, id int64) bool {
+	if hasPermission(r, PermPostsWrite) { return true }
+	author, err := h.posts.AuthorOf(r.Context(), id)
+	if err != nil { writeServiceError(w, err); return false }
+	if uid := currentUserID(r); author == nil || uid == nil || *author != *uid {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "you can only change your own posts"})
+		return false
+	}
+	return true
+}
+
+func postETag(p *Post) string { return fmt.Sprintf(`"%d-%d"`, p.ID, p.Version) }
 
-func NewPostHandler(s *PostService) *PostHandler { return &PostHandler{posts: s} }
+// writePost sends a post with its ETag, or 304 when the client's copy
+// (If-None-Match) is current.
+func writePost(w http.ResponseWriter, r *http.Request, status int, p *Post) {
+	etag := postETag(p)
+	w.Header().Set("ETag", etag)
+	if status == http.StatusOK && etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	writeJSON(w, status, p)
+}
+
+// ifMatchVersion returns the post version a write is conditional on: 0 for
+// an unconditional write (no If-Match, or "*"), -1 when none of the listed
+// ETags belongs to post id, which can never match. If-Match uses the strong
+// comparison, so weak tags (W/"...") never match either. ok is false when the
+// request must be rejected because If-Match is required but missing.
+func (h *PostHandler) ifMatchVersion(w http.ResponseWriter, r *http.Request, id int64) (version int, ok bool) {
+	header := strings.TrimSpace(r.Header.Get("If-Match"))
+	if header == "" {
+		if h.requireIfMatch {
+			writeJSON(w, http.StatusPreconditionRequired, map[string]string{"error": "If-Match header required"})
+			return 0, false
+		}
+		return 0, true
+	}
+	if header == "*" { return 0, true }
+	prefix := strconv.FormatInt(id, 10) + "-"
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if strings.HasPrefix(tag, "W/") { continue }
+		tag = strings.Trim(tag, `"`)
+		if v, err := strconv.Atoi(strings.TrimPrefix(tag, prefix)); err == nil && strings.HasPrefix(tag, prefix) {
+			return v, true
+		}
+	}
+	return -1, true
+}
+
+type postListResponse struct {
+	Items      []*Post `json:"items"`
+	NextCursor string  `json:"next_cursor,omitempty"`
+}
 
+// HandleList lists published posts.
 func (h *PostHandler) HandleList(w http.ResponseWriter, r *http.Request) {
-	posts, err := h.posts.List(r.Context(), 50, 0)
+	params, err := parsePostListParams(r)
+	if err != nil { writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()}); return }
+	params.Statuses = []string{PostStatusPublished}
+	h.writeList(w, r, params)
+}
+
+// HandleAdminList lists posts in every status, optionally filtered by ?status=.
+func (h *PostHandler) HandleAdminList(w http.ResponseWriter, r *http.Request) {
+	params, err := parsePostListParams(r)
+	if err != nil { writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()}); return }
+	h.writeList(w, r, params)
+}
+
+func (h *PostHandler) writeList(w http.ResponseWriter, r *http.Request, params PostListParams) {
+	posts, next, err := h.posts.List(r.Context(), params)
 	if err != nil { writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()}); return }
-	writeJSON(w, http.StatusOK, posts)
+	if posts == nil { posts = []*Post{} }
+	if params.ExcerptOnly {
+		for _, p := range posts { p.Content, p.ContentHTML = "", "" }
+	}
+	setNextLink(w, r, next)
+	writeJSON(w, http.StatusOK, postListResponse{Items: posts, NextCursor: next})
+}
+
+// HandleSearch is HandleList with a mandatory full-text query; results are
+// ranked by relevance unless another sort is requested.
+func (h *PostHandler) HandleSearch(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("q") == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "missing search query"})
+		return
+	}
+	h.HandleList(w, r)
 }
 
 func (h *PostHandler) HandleGet(w http.ResponseWriter, r *http.Request) {
+	idStr := chi.URLParam(r, "id")
+	id, _ := strconv.ParseInt(idStr, 10, 64)
+	p, err := h.posts.GetByID(r.Context(), id)
+	if err != nil || p.Status != PostStatusPublished { writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"}); return }
+	writePost(w, r, http.StatusOK, p)
+}
+
+// HandleAdminGet returns a post regardless of its status.
+func (h *PostHandler) HandleAdminGet(w http.ResponseWriter, r *http.Request) {
 	idStr := chi.URLParam(r, "id")
 	id, _ := strconv.ParseInt(idStr, 10, 64)
 	p, err := h.posts.GetByID(r.Context(), id)
 	if err != nil { writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"}); return }
-	writeJSON(w, http.StatusOK, p)
+	writePost(w, r, http.StatusOK, p)
+}
+
+const maxRelatedPosts = 20
+
+// HandleRelated lists published posts similar to a published post
+// (?limit=, default 5).
+func (h *PostHandler) HandleRelated(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	limit := 5
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxRelatedPosts { writeJSON(w, http.StatusBadRequest, map[string]string{"error": "limit must be between 1 and 20"}); return }
+		limit = n
+	}
+	p, err := h.posts.GetByID(r.Context(), id)
+	if err != nil || p.Status != PostStatusPublished { writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"}); return }
+	posts, err := h.posts.Related(r.Context(), id, limit)
+	if err != nil { writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()}); return }
+	writeJSON(w, http.StatusOK, posts)
 }
 
 type createPostRequest struct {
-	Title   string `json:"title"`
-	Content string `json:"content"`
+	Title     string     `json:"title"`
+	// Slug is generated from the title when empty.
+	Slug      string     `json:"slug"`
+	Content   string     `json:"content"`
+	// ContentFormat is plain, markdown or html.
+	ContentFormat string `json:"content_format"`
+	Tags      []string   `json:"tags"`
+	Status    string     `json:"status"`
+	PublishAt *time.Time `json:"publish_at"`
 }
 
 func (h *PostHandler) HandleCreate(w http.ResponseWriter, r *http.Request) {
 	var req createPostRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Title == "" || req.Content == "" {
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Title == "" || req.Content == "" || len(distinctPostTags(req.Tags)) > maxPostTags ||
+		(req.ContentFormat != "" && !validContentFormat(req.ContentFormat)) {
 		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request"})
 		return
 	}
-	p, err := h.posts.Create(r.Context(), req.Title, req.Content, nil, nil)
-	if err != nil { writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()}); return }
-	writeJSON(w, http.StatusCreated, p)
+	in := PostInput{Title: req.Title, Slug: req.Slug, Content: req.Content, ContentFormat: req.ContentFormat, Tags: req.Tags, Status: req.Status, PublishAt: req.PublishAt}
+	in.AuthorID = currentUserID(r)
+	p, err := h.posts.Create(r.Context(), in)
+	if err != nil { writeServiceError(w, err); return }
+	writePost(w, r, http.StatusCreated, p)
 }
 
 type updatePostRequest struct {
-	Title   string `json:"title"`
-	Content string `json:"content"`
+	Title     string     `json:"title"`
+	// Slug replaces the slug when present; an empty one regenerates it from the title.
+	Slug      *string    `json:"slug"`
+	Content   string     `json:"content"`
+	// ContentFormat is plain, markdown or html.
+	ContentFormat string `json:"content_format"`
+	Tags      []string   `json:"tags"`
+	Status    string     `json:"status"`
+	PublishAt *time.Time `json:"publish_at"`
 }
 
 func (h *PostHandler) HandleUpdate(w http.ResponseWriter, r *http.Request) {
 	idStr := chi.URLParam(r, "id")
 	id, _ := strconv.ParseInt(idStr, 10, 64)
 	var req updatePostRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Title == "" || req.Content == "" {
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Title == "" || req.Content == "" || len(distinctPostTags(req.Tags)) > maxPostTags ||
+		(req.ContentFormat != "" && !validContentFormat(req.ContentFormat)) {
 		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request"})
 		return
 	}
-	if err := h.posts.Update(r.Context(), id, req.Title, req.Content); err != nil {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+	if !h.authorize(w, r, id) { return }
+	version, ok := h.ifMatchVersion(w, r, id)
+	if !ok { return }
+	p, err := h.posts.Update(r.Context(), id, PostUpdate{
+		Title:     req.Title,
+		SetSlug:   req.Slug != nil,
+		Slug:      derefString(req.Slug),
+		Content:   req.Content,
+		ContentFormat: req.ContentFormat,
+		Tags:      req.Tags,
+		Status:    req.Status,
+		PublishAt: req.PublishAt,
+		EditorID:  currentUserID(r),
+		IfVersion: version,
+	})
+	if err != nil { writeServiceError(w, err); return }
+	w.Header().Set("ETag", postETag(p))
+	writeJSON(w, http.StatusOK, map[string]bool{"updated": true})
+}
+
+const maxPatchBody = 1 << 20
+
+// HandlePatch applies a JSON Merge Patch to a post. Without If-Match the
+// read-modify-write is retried a few times if another write slips in.
+func (h *PostHandler) HandlePatch(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt != "application/merge-patch+json" && mt != "application/json" {
+		writeJSON(w, http.StatusUnsupportedMediaType, map[string]string{"error": "expected application/merge-patch+json"})
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxPatchBody))
+	if err != nil { writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request"}); return }
+	if !h.authorize(w, r, id) { return }
+	version, ok := h.ifMatchVersion(w, r, id)
+	if !ok { return }
+	for attempt := 0; ; attempt++ {
+		p, err := h.posts.GetByID(r.Context(), id)
+		if err != nil { writeServiceError(w, err); return }
+		if version != 0 && version != p.Version { writeServiceError(w, ErrVersionMismatch); return }
+		u, errs := applyPostMergePatch(p, body)
+		if len(errs) > 0 { writeValidationErrors(w, errs); return }
+		u.EditorID = currentUserID(r)
+		u.IfVersion = p.Version
+		p, err = h.posts.Update(r.Context(), id, u)
+		if errors.Is(err, ErrVersionMismatch) && version == 0 && attempt < 2 { continue }
+		if err != nil { writeServiceError(w, err); return }
+		w.Header().Set("ETag", postETag(p))
+		writeJSON(w, http.StatusOK, p)
 		return
 	}
-	writeJSON(w, http.StatusOK, map[string]bool{"updated": true})
+}
+
+// HandleGetBySlug returns a published post by slug. Former slugs of a post
+// redirect permanently to its current one.
+func (h *PostHandler) HandleGetBySlug(w http.ResponseWriter, r *http.Request) {
+	p, current, err := h.posts.GetBySlug(r.Context(), chi.URLParam(r, "slug"))
+	if current != "" {
+		target := "/posts/by-slug/" + current
+		if r.URL.RawQuery != "" { target += "?" + r.URL.RawQuery }
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+		return
+	}
+	if err != nil || p.Status != PostStatusPublished { writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"}); return }
+	writePost(w, r, http.StatusOK, p)
 }
 
 func (h *PostHandler) HandleDelete(w http.ResponseWriter, r *http.Request) {
 	idStr := chi.URLParam(r, "id")
 	id, _ := strconv.ParseInt(idStr, 10, 64)
-	if err := h.posts.Delete(r.Context(), id); err != nil { writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()}); return }
+	if !h.authorize(w, r, id) { return }
+	version, ok := h.ifMatchVersion(w, r, id)
+	if !ok { return }
+	if err := h.posts.Delete(r.Context(), id, version); err != nil { writeServiceError(w, err); return }
 	writeJSON(w, http.StatusOK, map[string]bool{"deleted": true})
 }
 
+// HandleTrash lists deleted posts; it accepts the parameters of HandleAdminList.
+func (h *PostHandler) HandleTrash(w http.ResponseWriter, r *http.Request) {
+	params, err := parsePostListParams(r)
+	if err != nil { writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()}); return }
+	params.Deleted = true
+	h.writeList(w, r, params)
+}
+
+func (h *PostHandler) HandleRestore(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if !h.authorize(w, r, id) { return }
+	if err := h.posts.Restore(r.Context(), id); err != nil { writeServiceError(w, err); return }
+	writeJSON(w, http.StatusOK, map[string]bool{"restored": true})
+}
+
+func (h *PostHandler) HandleListRevisions(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	revs, err := h.posts.ListRevisions(r.Context(), id)
+	if errors.Is(err, ErrNotFound) { writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"}); return }
+	if err != nil { writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()}); return }
+	writeJSON(w, http.StatusOK, revs)
+}
+
+func (h *PostHandler) HandleGetRevision(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	rev, _ := strconv.Atoi(chi.URLParam(r, "rev"))
+	pr, err := h.posts.GetRevision(r.Context(), id, rev)
+	if err != nil { writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"}); return }
+	writeJSON(w, http.StatusOK, pr)
+}
+
+type revisionDiffResponse struct {
+	From    int      `json:"from"`
+	To      int      `json:"to"`
+	Title   []diffOp `json:"title"`
+	Content []diffOp `json:"content"`
+}
+
+// HandleDiffRevisions compares revisions ?from= and ?to=; to defaults to the
+// latest revision and from to the one before it.
+func (h *PostHandler) HandleDiffRevisions(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	revs, err := h.posts.ListRevisions(r.Context(), id)
+	if errors.Is(err, ErrNotFound) { writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"}); return }
+	if err != nil { writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()}); return }
+	to := revs[0].Rev
+	if s := r.URL.Query().Get("to"); s != "" {
+		if to, err = strconv.Atoi(s); err != nil { writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid to"}); return }
+	}
+	from := max(to-1, 1)
+	if s := r.URL.Query().Get("from"); s != "" {
+		if from, err = strconv.Atoi(s); err != nil { writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid from"}); return }
+	}
+	a, err := h.posts.GetRevision(r.Context(), id, from)
+	if err != nil { writeJSON(w, http.StatusNotFound, map[string]string{"error": "revision not found"}); return }
+	b, err := h.posts.GetRevision(r.Context(), id, to)
+	if err != nil { writeJSON(w, http.StatusNotFound, map[string]string{"error": "revision not found"}); return }
+	writeJSON(w, http.StatusOK, revisionDiffResponse{From: from, To: to, Title: diffWords(a.Title, b.Title), Content: diffLines(a.Content, b.Content)})
+}
+
+func (h *PostHandler) HandleRestoreRevision(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	rev, _ := strconv.Atoi(chi.URLParam(r, "rev"))
+	if !h.authorize(w, r, id) { return }
+	p, err := h.posts.RestoreRevision(r.Context(), id, rev, currentUserID(r))
+	if err != nil { writeServiceError(w, err); return }
+	writePost(w, r, http.StatusOK, p)
+}
+
+// Tags
+
+type TagHandler struct { tags *TagService }
+
+func NewTagHandler(s *TagService) *TagHandler { return &TagHandler{tags: s} }
+
+func (h *TagHandler) HandleList(w http.ResponseWriter, r *http.Request) {
+	tags, err := h.tags.List(r.Context())
+	if err != nil { writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()}); return }
+	writeJSON(w, http.StatusOK, tags)
+}
+
+func (h *TagHandler) HandleGet(w http.ResponseWriter, r *http.Request) {
+	t, err := h.tags.GetBySlug(r.Context(), chi.URLParam(r, "slug"))
+	if err != nil { writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"}); return }
+	writeJSON(w, http.StatusOK, t)
+}
+
+type mergeTagRequest struct { Into string `json:"into"` }
+
+func (h *TagHandler) HandleMerge(w http.ResponseWriter, r *http.Request) {
+	var req mergeTagRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Into == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		return
+	}
+	t, err := h.tags.Merge(r.Context(), chi.URLParam(r, "slug"), req.Into)
+	if errors.Is(err, ErrNotFound) { writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"}); return }
+	if err != nil { writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()}); return }
+	writeJSON(w, http.StatusOK, t)
+}
+
+type addTagAliasRequest struct { Alias string `json:"alias"` }
+
+func (h *TagHandler) HandleAddAlias(w http.ResponseWriter, r *http.Request) {
+	var req addTagAliasRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Alias == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		return
+	}
+	t, err := h.tags.AddAlias(r.Context(), chi.URLParam(r, "slug"), req.Alias)
+	if errors.Is(err, ErrNotFound) { writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"}); return }
+	if err != nil { writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()}); return }
+	writeJSON(w, http.StatusOK, t)
+}
+
+func (h *TagHandler) HandleDelete(w http.ResponseWriter, r *http.Request) {
+	if err := h.tags.Delete(r.Context(), chi.URLParam(r, "slug")); err != nil {
+		if errors.Is(err, ErrNotFound) { writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"}); return }
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"deleted": true})
+}
+
+// Trending
+
+type TrendingHandler struct { stories *StoryService }
+
+func NewTrendingHandler(s *StoryService) *TrendingHandler { return &TrendingHandler{stories: s} }
+
+const maxTrendingWindow = 7 * 24 * time.Hour
+
+// HandleTrending returns the top stories and keywords of ?window= (a Go
+// duration such as 1h or 24h, or hour/day; default 1h).
+func (h *TrendingHandler) HandleTrending(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	window := time.Hour
+	switch s := q.Get("window"); s {
+	case "", "hour":
+	case "day": window = 24 * time.Hour
+	default:
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 || d > maxTrendingWindow {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "window must be a duration between 1s and 168h"})
+			return
+		}
+		window = d
+	}
+	limit := 10
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > 50 { writeJSON(w, http.StatusBadRequest, map[string]string{"error": "limit must be between 1 and 50"}); return }
+		limit = n
+	}
+	t, err := h.stories.Trending(r.Context(), window, limit)
+	if err != nil { writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()}); return }
+	writeJSON(w, http.StatusOK, t)
+}
+
 // Feeds
 
 type FeedHandler struct { feeds *FeedService }
@@ -153,7 +1234,10 @@ func (h *FeedHandler) HandleList(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, feeds)
 }
 
-type createFeedRequest struct { URL string `json:"url"` }
+type createFeedRequest struct {
+	URL   string  `json:"url"`
+	Group *string `json:"group"`
+}
 
 func (h *FeedHandler) HandleCreate(w http.ResponseWriter, r *http.Request) {
 	var req createFeedRequest
@@ -161,14 +1245,46 @@ func (h *FeedHandler) HandleCreate(w http.ResponseWriter, r *http.Request) {
 		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request"})
 		return
 	}
-	f, err := h.feeds.Create(r.Context(), req.URL)
+	f, err := h.feeds.Create(r.Context(), req.URL, normalizeFeedGroup(req.Group))
 	if err != nil { writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()}); return }
 	writeJSON(w, http.StatusCreated, f)
 }
 
+type updateFeedRequest struct { Group *string `json:"group"` }
+
+// HandleUpdate sets the group of a feed; a null or blank group ungroups it.
+func (h *FeedHandler) HandleUpdate(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	var req updateFeedRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		return
+	}
+	f, err := h.feeds.SetGroup(r.Context(), id, normalizeFeedGroup(req.Group))
+	if err != nil { writeServiceError(w, err); return }
+	writeJSON(w, http.StatusOK, f)
+}
+
+func normalizeFeedGroup(g *string) *string {
+	if g == nil { return nil }
+	return optionalStr(strings.TrimSpace(*g))
+}
+
 func (h *FeedHandler) HandleDelete(w http.ResponseWriter, r *http.Request) {
 	idStr := chi.URLParam(r, "id")
 	id, _ := strconv.ParseInt(idStr, 10, 64)
-	if err := h.feeds.Delete(r.Context(), id); err != nil { writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()}); return }
+	if err := h.feeds.Delete(r.Context(), id); err != nil { writeServiceError(w, err); return }
 	writeJSON(w, http.StatusOK, map[string]bool{"deleted": true})
+}
+
+func (h *FeedHandler) HandleTrash(w http.ResponseWriter, r *http.Request) {
+	feeds, err := h.feeds.ListDeleted(r.Context())
+	if err != nil { writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()}); return }
+	writeJSON(w, http.StatusOK, feeds)
+}
+
+func (h *FeedHandler) HandleRestore(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err := h.feeds.Restore(r.Context(), id); err != nil { writeServiceError(w, err); return }
+	writeJSON(w, http.StatusOK, map[string]bool{"restored": true})
 }
\ No newline at end of file
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIfMatchVersion(t *testing.T) {
+	tests := []struct {
+		header  string
+		require bool
+		version int
+		ok      bool
+	}{
+		{"", false, 0, true},
+		{"", true, 0, false},
+		{"*", true, 0, true},
+		{`"7-3"`, false, 3, true},
+		{` "7-3" `, true, 3, true},
+		{`"8-3", "7-4"`, false, 4, true},
+		{`"8-3"`, false, -1, true},
+		{`"77-3"`, false, -1, true},
+		{`"7-x"`, false, -1, true},
+		// If-Match uses the strong comparison: weak tags never match.
+		{`W/"7-3"`, false, -1, true},
+		{`W/"7-3", "7-5"`, false, 5, true},
+	}
+	for _, tt := range tests {
+		h := &PostHandler{requireIfMatch: tt.require}
+		r := httptest.NewRequest(http.MethodPut, "/posts/7", nil)
+		if tt.header != "" { r.Header.Set("If-Match", tt.header) }
+		w := httptest.NewRecorder()
+		version, ok := h.ifMatchVersion(w, r, 7)
+		if version != tt.version || ok != tt.ok {
+			t.Errorf("If-Match %q (required %v) = %d, %v, want %d, %v", tt.header, tt.require, version, ok, tt.version, tt.ok)
+		}
+		if !ok && w.Code != http.StatusPreconditionRequired { t.Errorf("If-Match %q: status %d, want 428", tt.header, w.Code) }
+	}
+}
+
+func TestPostETagRoundTrip(t *testing.T) {
+	p := &Post{ID: 12, Version: 5}
+	r := httptest.NewRequest(http.MethodPut, "/posts/12", nil)
+	r.Header.Set("If-Match", postETag(p))
+	if version, _ := (&PostHandler{}).ifMatchVersion(httptest.NewRecorder(), r, p.ID); version != p.Version {
+		t.Errorf("If-Match %s gave version %d, want %d", postETag(p), version, p.Version)
+	}
+	if !etagMatches(postETag(p), postETag(p)) { t.Errorf("If-None-Match %s does not match itself", postETag(p)) }
+}
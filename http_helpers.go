@@ -2,7 +2,11 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
+	"strings"
 )
 
 func writeJSON(w http.ResponseWriter, status int, v interface{}) {
@@ -11,6 +15,43 @@ func writeJSON(w http.ResponseWriter, status int, v interface{}) {
 	_ = json.NewEncoder(w).Encode(v)
 }
 
+// writeServiceError reports a failed service call: ErrNotFound becomes a 404,
+// conflicts with existing data a 409, ErrVersionMismatch a 412, anything
+// else a 400 carrying the error message.
+func writeServiceError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrNotFound) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+		return
+	}
+	if errors.Is(err, ErrSlugTaken) || errors.Is(err, ErrRoleExists) || errors.Is(err, ErrRoleInUse) || errors.Is(err, ErrRoleBuiltin) ||
+		errors.Is(err, ErrEmailTaken) || errors.Is(err, ErrLastAdmin) || errors.Is(err, ErrTOTPEnabled) || errors.Is(err, ErrTOTPNotEnabled) ||
+		errors.Is(err, ErrTOTPNotSetUp) {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, ErrVersionMismatch) {
+		writeJSON(w, http.StatusPreconditionFailed, map[string]string{"error": "resource was modified; refetch and retry"})
+		return
+	}
+	writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+}
+
+// writeValidationErrors answers 422 with the problems found per field.
+func writeValidationErrors(w http.ResponseWriter, errs fieldErrors) {
+	writeJSON(w, http.StatusUnprocessableEntity, map[string]any{"error": "validation failed", "fields": errs})
+}
+
+// etagMatches implements the weak comparison of If-None-Match: header is a
+// list of entity tags or "*".
+func etagMatches(header, etag string) bool {
+	if header == "" { return false }
+	if strings.TrimSpace(header) == "*" { return true }
+	for _, t := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(t), "W/") == strings.TrimPrefix(etag, "W/") { return true }
+	}
+	return false
+}
+
 func jsonMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
@@ -18,12 +59,77 @@ func jsonMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// parseTrustedProxies reads a comma-separated list of IPs and CIDR ranges.
+func parseTrustedProxies(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" { continue }
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil { return nil, fmt.Errorf("invalid proxy address %q", s) }
+			bits := 128
+			if ip.To4() != nil { ip, bits = ip.To4(), 32 }
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil { return nil, fmt.Errorf("invalid proxy range %q", s) }
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func ipTrusted(ip net.IP, trusted []*net.IPNet) bool {
+	for _, n := range trusted {
+		if n.Contains(ip) { return true }
+	}
+	return false
+}
+
+// forwardedClientIP returns the client address of a request that reached us
+// from peer. Forwarding headers are only believed when peer is a trusted
+// proxy; X-Forwarded-For is then read from the right, skipping trusted
+// hops, since anything to the left of them was written by the client.
+func forwardedClientIP(peer, xff, xRealIP string, trusted []*net.IPNet) string {
+	ip := net.ParseIP(peer)
+	if ip == nil || !ipTrusted(ip, trusted) { return peer }
+	if xff != "" {
+		hops := strings.Split(xff, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := net.ParseIP(strings.TrimSpace(hops[i]))
+			if hop == nil { break }
+			if i == 0 || !ipTrusted(hop, trusted) { return hop.String() }
+		}
+		return peer
+	}
+	if real := net.ParseIP(strings.TrimSpace(xRealIP)); real != nil { return real.String() }
+	return peer
+}
+
+// realIPMiddleware replaces RemoteAddr with the client address, trusting
+// X-Forwarded-For and X-Real-IP only from the given proxies. Without any
+// the socket address is kept.
+func realIPMiddleware(trusted []*net.IPNet) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			peer := r.RemoteAddr
+			if host, _, err := net.SplitHostPort(peer); err == nil { peer = host }
+			if ip := forwardedClientIP(peer, r.Header.Get("X-Forwarded-For"), r.Header.Get("X-Real-IP"), trusted); ip != peer {
+				r.RemoteAddr = ip
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
 func corsMiddleware() func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			w.Header().Set("Access-Control-Allow-Origin", "*")
-			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
-			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, If-Match, If-None-Match")
+			w.Header().Set("Access-Control-Expose-Headers", "ETag, Link")
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
 			if r.Method == http.MethodOptions {
 				w.WriteHeader(http.StatusNoContent)
 				return
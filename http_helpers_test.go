@@ -0,0 +1,68 @@
+package main
+
+import "testing"
+
+func TestETagMatches(t *testing.T) {
+	tests := []struct {
+		header, etag string
+		want         bool
+	}{
+		{"", `"1-2"`, false},
+		{"*", `"1-2"`, true},
+		{" * ", `"1-2"`, true},
+		{`"1-2"`, `"1-2"`, true},
+		{`"1-3"`, `"1-2"`, false},
+		{`"1-1", "1-2"`, `"1-2"`, true},
+		{`"1-1","1-3"`, `"1-2"`, false},
+		// If-None-Match uses the weak comparison.
+		{`W/"1-2"`, `"1-2"`, true},
+		{`"abc"`, `W/"abc"`, true},
+		{`W/"abc"`, `W/"abc"`, true},
+		{`1-2`, `"1-2"`, false},
+	}
+	for _, tt := range tests {
+		if got := etagMatches(tt.header, tt.etag); got != tt.want {
+			t.Errorf("etagMatches(%q, %q) = %v, want %v", tt.header, tt.etag, got, tt.want)
+		}
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	nets, err := parseTrustedProxies(" 10.0.0.0/8, 192.0.2.10 ,, 2001:db8::/32,::1")
+	if err != nil { t.Fatal(err) }
+	want := []string{"10.0.0.0/8", "192.0.2.10/32", "2001:db8::/32", "::1/128"}
+	if len(nets) != len(want) { t.Fatalf("got %v, want %v", nets, want) }
+	for i := range want {
+		if nets[i].String() != want[i] { t.Errorf("net %d = %s, want %s", i, nets[i], want[i]) }
+	}
+	if nets, err := parseTrustedProxies(""); err != nil || len(nets) != 0 { t.Errorf("empty list: %v, %v", nets, err) }
+	for _, bad := range []string{"localhost", "10.0.0.0/33", "10.0.0.1, nope"} {
+		if _, err := parseTrustedProxies(bad); err == nil { t.Errorf("parseTrustedProxies(%q) succeeded", bad) }
+	}
+}
+
+func TestForwardedClientIP(t *testing.T) {
+	trusted, err := parseTrustedProxies("10.0.0.0/8, 2001:db8::1")
+	if err != nil { t.Fatal(err) }
+	tests := []struct {
+		name, peer, xff, realIP, want string
+	}{
+		{"direct client", "203.0.113.5", "", "", "203.0.113.5"},
+		{"untrusted peer cannot spoof XFF", "203.0.113.5", "198.51.100.1", "", "203.0.113.5"},
+		{"untrusted peer cannot spoof X-Real-IP", "203.0.113.5", "", "198.51.100.1", "203.0.113.5"},
+		{"trusted proxy", "10.0.0.2", "198.51.100.1", "", "198.51.100.1"},
+		{"client-written hops are ignored", "10.0.0.2", "1.2.3.4, 198.51.100.1", "", "198.51.100.1"},
+		{"trusted hops are skipped", "10.0.0.2", "198.51.100.1, 10.0.0.3, 10.1.2.3", "", "198.51.100.1"},
+		{"all hops trusted", "10.0.0.2", "10.0.0.4, 10.0.0.3", "", "10.0.0.4"},
+		{"garbage hop", "10.0.0.2", "198.51.100.1, bogus", "", "10.0.0.2"},
+		{"X-Real-IP from a trusted proxy", "10.0.0.2", "", " 198.51.100.1 ", "198.51.100.1"},
+		{"XFF wins over X-Real-IP", "10.0.0.2", "198.51.100.1", "198.51.100.2", "198.51.100.1"},
+		{"invalid X-Real-IP", "10.0.0.2", "", "nope", "10.0.0.2"},
+		{"IPv6 proxy", "2001:db8::1", "2001:db8:ffff::9", "", "2001:db8:ffff::9"},
+		{"unparsable peer", "@", "198.51.100.1", "", "@"},
+	}
+	for _, tt := range tests {
+		if got := forwardedClientIP(tt.peer, tt.xff, tt.realIP, trusted); got != tt.want { t.Errorf("%s: got %q, want %q", tt.name, got, tt.want) }
+	}
+	if got := forwardedClientIP("10.0.0.2", "198.51.100.1", "", nil); got != "10.0.0.2" { t.Errorf("without trusted proxies: got %q", got) }
+}
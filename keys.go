@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// signingKey is one key of a JWT key directory. The kid is the file name
+// without ".pem"; a kid starting with a YYYY-MM-DD date is published in the
+// JWKS right away but only signs tokens from that date on, which lets
+// verifiers fetch a key before it is used.
+type signingKey struct {
+	kid        string
+	method     jwt.SigningMethod
+	private    crypto.Signer
+	public     crypto.PublicKey
+	activeFrom time.Time
+	// retiredAt is when the key file disappeared; the key keeps verifying
+	// the tokens it signed until they expire.
+	retiredAt time.Time
+}
+
+// loadSigningKeys reads every *.pem private key of dir. RSA keys sign with
+// RS256, Ed25519 keys with EdDSA.
+func loadSigningKeys(dir string) (map[string]*signingKey, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil { return nil, err }
+	keys := map[string]*signingKey{}
+	for _, f := range files {
+		k, err := loadSigningKey(f)
+		if err != nil { return nil, fmt.Errorf("%s: %w", f, err) }
+		keys[k.kid] = k
+	}
+	return keys, nil
+}
+
+func loadSigningKey(path string) (*signingKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil { return nil, err }
+	block, _ := pem.Decode(data)
+	if block == nil { return nil, errors.New("no PEM block") }
+	var priv any
+	switch block.Type {
+	case "PRIVATE KEY":
+		priv, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		priv, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil { return nil, err }
+	k := &signingKey{kid: strings.TrimSuffix(filepath.Base(path), ".pem")}
+	switch p := priv.(type) {
+	case *rsa.PrivateKey:
+		if p.N.BitLen() < 2048 { return nil, errors.New("RSA keys must be at least 2048 bits") }
+		k.method, k.private, k.public = jwt.SigningMethodRS256, p, &p.PublicKey
+	case ed25519.PrivateKey:
+		k.method, k.private, k.public = jwt.SigningMethodEdDSA, p, p.Public()
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", priv)
+	}
+	if len(k.kid) >= 10 {
+		if t, err := time.Parse("2006-01-02", k.kid[:10]); err == nil { k.activeFrom = t }
+	}
+	return k, nil
+}
+
+// jwk is a public key in JSON Web Key form (RFC 7517, RFC 8037).
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+type jwkSet struct {
+	Keys []jwk `json:"keys"`
+}
+
+func (k *signingKey) jwk() jwk {
+	out := jwk{Kid: k.kid, Use: "sig", Alg: k.method.Alg()}
+	b64 := base64.RawURLEncoding.EncodeToString
+	switch p := k.public.(type) {
+	case *rsa.PublicKey:
+		out.Kty, out.N, out.E = "RSA", b64(p.N.Bytes()), b64(big.NewInt(int64(p.E)).Bytes())
+	case ed25519.PublicKey:
+		out.Kty, out.Crv, out.X = "OKP", "Ed25519", b64(p)
+	}
+	return out
+}
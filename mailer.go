@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Mail is a plain-text email.
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers emails. MAIL_TRANSPORT picks the implementation: smtp
+// for real delivery, log or file for local testing; production refuses log.
+type Mailer interface {
+	Send(ctx context.Context, m Mail) error
+}
+
+func NewMailer(cfg Config) (Mailer, error) {
+	switch cfg.MailTransport {
+	case "log":
+		return logMailer{}, nil
+	case "file":
+		if err := os.MkdirAll(cfg.MailDir, 0o755); err != nil { return nil, err }
+		return fileMailer{dir: cfg.MailDir, from: cfg.MailFrom}, nil
+	case "smtp":
+		if cfg.SMTPAddr == "" { return nil, fmt.Errorf("MAIL_TRANSPORT=smtp requires SMTP_ADDR") }
+		return smtpMailer{addr: cfg.SMTPAddr, username: cfg.SMTPUsername, password: cfg.SMTPPassword, from: cfg.MailFrom}, nil
+	}
+	return nil, fmt.Errorf("unknown MAIL_TRANSPORT %q", cfg.MailTransport)
+}
+
+// formatMail renders m as an RFC 5322 message with a quoted-printable body.
+func formatMail(from string, m Mail) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", m.To)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n")
+	qp := quotedprintable.NewWriter(&buf)
+	_, _ = qp.Write([]byte(strings.ReplaceAll(m.Body, "\n", "\r\n")))
+	_ = qp.Close()
+	return buf.Bytes()
+}
+
+// logMailer only notes that a message was sent: bodies carry verification
+// and password reset links, which must not end up in logs. Use file to read
+// them during development.
+type logMailer struct{}
+
+func (logMailer) Send(ctx context.Context, m Mail) error {
+	log.Printf("mail to %s: %s", m.To, m.Subject)
+	return nil
+}
+
+// fileMailer writes every message to its own .eml file in dir.
+type fileMailer struct {
+	dir  string
+	from string
+}
+
+func (f fileMailer) Send(ctx context.Context, m Mail) error {
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405.000000000"), randomToken(4))
+	return os.WriteFile(filepath.Join(f.dir, name), formatMail(f.from, m), 0o644)
+}
+
+// smtpMailer sends through an SMTP server, upgrading to TLS when the server
+// offers STARTTLS. Authentication is skipped without a username.
+type smtpMailer struct {
+	addr     string
+	username string
+	password string
+	from     string
+}
+
+func (s smtpMailer) Send(ctx context.Context, m Mail) error {
+	var auth smtp.Auth
+	if s.username != "" {
+		host, _, _ := net.SplitHostPort(s.addr)
+		auth = smtp.PlainAuth("", s.username, s.password, host)
+	}
+	return smtp.SendMail(s.addr, auth, s.from, []string{m.To}, formatMail(s.from, m))
+}
@@ -48,24 +48,77 @@ func main() {
 		log.Fatalf("failed to run migrations: %v", err)
 	}
 
+	if err := backfillPosts(context.Background(), db); err != nil {
+		log.Fatalf("failed to backfill posts: %v", err)
+	}
+	if err := backfillPostSlugs(context.Background(), db); err != nil {
+		log.Fatalf("failed to backfill post slugs: %v", err)
+	}
+
 	if err := ensureDefaultAdmin(db, cfg); err != nil {
 		log.Fatalf("failed to ensure default admin: %v", err)
 	}
 
-	jwtManager := NewJWTManager(cfg.JWTSecret, 24*time.Hour)
+	jwtManager := NewJWTManager(cfg.JWTSecret, cfg.AccessTokenTTL)
+	if cfg.JWTKeysDir != "" {
+		if jwtManager, err = NewJWTManagerFromDir(cfg.JWTKeysDir, cfg.AccessTokenTTL); err != nil {
+			log.Fatalf("failed to load JWT keys: %v", err)
+		}
+	}
 	passwordHasher := NewPasswordHasher()
 	feedService := NewFeedService(db)
 	postService := NewPostService(db)
+	tagService := NewTagService(db)
 	userService := NewUserService(db, passwordHasher)
+	sessionService := NewSessionService(db, jwtManager, cfg.RefreshTokenTTL, cfg.RequireAdmin2FA)
+	roleService := NewRoleService(db)
+	if cfg.AllowRegistration {
+		if _, err := roleService.Get(context.Background(), cfg.RegistrationRole); err != nil {
+			log.Fatalf("invalid REGISTRATION_ROLE %q: %v", cfg.RegistrationRole, err)
+		}
+	}
+	mailer, err := NewMailer(cfg)
+	if err != nil {
+		log.Fatalf("failed to set up mailer: %v", err)
+	}
+	site := NewSite(cfg)
+	auditLog := NewAuditLog(db)
+	loginThrottle := NewLoginThrottle(db, ThrottleOptions{
+		FreeFailures:   cfg.LoginFreeFailures,
+		MaxFailures:    cfg.LoginMaxFailures,
+		IPFreeFailures: cfg.LoginIPFreeFailures,
+		IPMaxFailures:  cfg.LoginIPMaxFailures,
+		MaxDelay:       cfg.LoginMaxDelay,
+		Lockout:        cfg.LoginLockout,
+	})
+	twoFactorService := NewTwoFactorService(db, userService, auditLog, site.Title)
+	apiKeyService := NewAPIKeyService(db, cfg.RequireAdmin2FA)
+	accountService := NewAccountService(db, userService, mailer, site, AccountOptions{
+		AllowRegistration: cfg.AllowRegistration,
+		RegistrationRole:  cfg.RegistrationRole,
+		VerifyEmailTTL:    cfg.VerifyEmailTTL,
+		VerifyEmailURL:    cfg.VerifyEmailURL,
+		ResetPasswordTTL:  cfg.ResetPasswordTTL,
+		ResetPasswordInterval: cfg.ResetPasswordInterval,
+		ResetPasswordURL:  cfg.ResetPasswordURL,
+	})
 
 	// Start background feed worker
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	go StartFeedWorker(ctx, feedService, postService, 10*time.Minute)
+	go StartPublisher(ctx, postService, 30*time.Second)
+	if cfg.TrashRetention > 0 {
+		go StartTrashPurger(ctx, postService, feedService, userService, cfg.TrashRetention, time.Hour)
+	}
+	go StartAuthPurger(ctx, sessionService, accountService, loginThrottle, time.Hour)
+	if cfg.JWTKeysDir != "" {
+		go StartKeyReloader(ctx, jwtManager, time.Minute)
+	}
 
 	r := chi.NewRouter()
 	r.Use(middleware.RequestID)
-	r.Use(middleware.RealIP)
+	r.Use(realIPMiddleware(cfg.TrustedProxies))
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
 	r.Use(jsonMiddleware)
@@ -81,43 +134,157 @@ func main() {
 	r.Get("/docs", ServeSwaggerUI)
 
 	// Auth
-	authHandler := NewAuthHandler(userService, jwtManager)
+	authHandler := NewAuthHandler(userService, sessionService, jwtManager, loginThrottle, twoFactorService)
 	r.Post("/admin/login", authHandler.HandleLogin)
+	r.Post("/auth/login/2fa", authHandler.HandleLoginTwoFactor)
+	r.Post("/auth/refresh", authHandler.HandleRefresh)
+	r.Post("/auth/logout", authHandler.HandleLogout)
+	r.Get("/.well-known/jwks.json", authHandler.HandleJWKS)
+
+	authn := JWTAuthMiddleware(jwtManager, sessionService, apiKeyService)
+	can := func(perms ...string) func(http.Handler) http.Handler { return RequirePermission(roleService, perms...) }
+
+	accountHandler := NewAccountHandler(accountService, userService, sessionService)
+	r.Post("/auth/register", accountHandler.HandleRegister)
+	r.Post("/auth/verify-email", accountHandler.HandleVerifyEmail)
+	r.With(authn).Post("/auth/resend-verification", accountHandler.HandleResendVerification)
+	r.Post("/auth/password/forgot", accountHandler.HandleForgotPassword)
+	r.Post("/auth/password/reset", accountHandler.HandleResetPassword)
+	r.With(authn, SessionOnly).Post("/auth/password/change", accountHandler.HandleChangePassword)
+
+	// Two-factor authentication; open to admins who are told to enable it.
+	twoFactorHandler := NewTwoFactorHandler(twoFactorService, userService, cfg.RequireAdmin2FA)
+	r.Route("/auth/2fa", func(r chi.Router) {
+		r.Use(authn, SessionOnly)
+		r.Get("/", twoFactorHandler.HandleStatus)
+		r.Post("/setup", twoFactorHandler.HandleSetup)
+		r.Post("/enable", twoFactorHandler.HandleEnable)
+		r.Post("/disable", twoFactorHandler.HandleDisable)
+		r.Post("/recovery-codes", twoFactorHandler.HandleRecoveryCodes)
+	})
+
+	// API keys, for scripts; they authenticate like access tokens.
+	apiKeyHandler := NewAPIKeyHandler(apiKeyService, userService, roleService)
+	r.Route("/auth/api-keys", func(r chi.Router) {
+		r.Use(authn, SessionOnly)
+		r.Get("/", apiKeyHandler.HandleList)
+		r.Post("/", apiKeyHandler.HandleCreate)
+		r.Delete("/{id}", apiKeyHandler.HandleRevoke)
+	})
 
 	// Posts
-	postHandler := NewPostHandler(postService)
+	postHandler := NewPostHandler(postService, cfg.RequireIfMatch)
+	r.Route("/admin/posts", func(r chi.Router) {
+		r.Use(authn, can(PermPostsRead))
+		r.Get("/", postHandler.HandleAdminList)
+		r.Get("/{id}", postHandler.HandleAdminGet)
+	})
 	r.Route("/posts", func(r chi.Router) {
 		r.Get("/", postHandler.HandleList)
+		r.Get("/search", postHandler.HandleSearch)
+		r.Get("/by-slug/{slug}", postHandler.HandleGetBySlug)
 		r.Get("/{id}", postHandler.HandleGet)
+		r.Get("/{id}/related", postHandler.HandleRelated)
 		r.Group(func(r chi.Router) {
-			r.Use(JWTAuthMiddleware(jwtManager))
-			r.Use(AdminOnlyMiddleware(userService))
+			r.Use(authn, can(PermPostsRead))
+			r.Get("/trash", postHandler.HandleTrash)
+			r.Get("/{id}/revisions", postHandler.HandleListRevisions)
+			r.Get("/{id}/revisions/diff", postHandler.HandleDiffRevisions)
+			r.Get("/{id}/revisions/{rev}", postHandler.HandleGetRevision)
+		})
+		// posts:write_own lets a user change only their own posts; the handlers check ownership.
+		r.Group(func(r chi.Router) {
+			r.Use(authn, can(PermPostsWrite, PermPostsWriteOwn))
 			r.Post("/", postHandler.HandleCreate)
 			r.Put("/{id}", postHandler.HandleUpdate)
+			r.Patch("/{id}", postHandler.HandlePatch)
 			r.Delete("/{id}", postHandler.HandleDelete)
+			r.Post("/{id}/restore", postHandler.HandleRestore)
+			r.Post("/{id}/revisions/{rev}/restore", postHandler.HandleRestoreRevision)
+		})
+	})
+
+	// Tags
+	tagHandler := NewTagHandler(tagService)
+	r.Route("/tags", func(r chi.Router) {
+		r.Get("/", tagHandler.HandleList)
+		r.Get("/{slug}", tagHandler.HandleGet)
+		r.Group(func(r chi.Router) {
+			r.Use(authn, can(PermTagsManage))
+			r.Post("/{slug}/merge", tagHandler.HandleMerge)
+			r.Post("/{slug}/aliases", tagHandler.HandleAddAlias)
+			r.Delete("/{slug}", tagHandler.HandleDelete)
 		})
 	})
 
 	// Users
-	userHandler := NewUserHandler(userService)
+	securityHandler := NewSecurityHandler(loginThrottle, auditLog, userService)
+	r.Group(func(r chi.Router) {
+		r.Use(authn, can(PermUsersManage))
+		r.Get("/audit-log", securityHandler.HandleAuditLog)
+		r.Get("/login-locks", securityHandler.HandleLocks)
+		r.Delete("/login-locks/{key}", securityHandler.HandleUnlock)
+	})
+	userHandler := NewUserHandler(userService, roleService, twoFactorService)
 	r.Route("/users", func(r chi.Router) {
 		r.Group(func(r chi.Router) {
-			r.Use(JWTAuthMiddleware(jwtManager))
-			r.Use(AdminOnlyMiddleware(userService))
+			r.Use(authn, can(PermUsersManage))
 			r.Get("/", userHandler.HandleList)
 			r.Post("/", userHandler.HandleCreate)
+			r.Get("/trash", userHandler.HandleTrash)
+			r.Get("/{id}", userHandler.HandleGet)
+			r.Patch("/{id}", userHandler.HandleUpdate)
+			r.Delete("/{id}", userHandler.HandleDelete)
+			r.Post("/{id}/restore", userHandler.HandleRestore)
+			r.Put("/{id}/role", userHandler.HandleSetRole)
+			r.Post("/{id}/password", userHandler.HandleResetPassword)
+			r.Post("/{id}/unlock", securityHandler.HandleUnlockUser)
+			r.Delete("/{id}/2fa", userHandler.HandleResetTwoFactor)
 		})
 	})
 
+	// Roles
+	roleHandler := NewRoleHandler(roleService)
+	r.Route("/roles", func(r chi.Router) {
+		r.Use(authn)
+		r.Group(func(r chi.Router) {
+			r.Use(can(PermRolesManage, PermUsersManage))
+			r.Get("/", roleHandler.HandleList)
+			r.Get("/permissions", roleHandler.HandlePermissions)
+			r.Get("/{name}", roleHandler.HandleGet)
+		})
+		r.Group(func(r chi.Router) {
+			r.Use(can(PermRolesManage))
+			r.Post("/", roleHandler.HandleCreate)
+			r.Put("/{name}", roleHandler.HandleUpdate)
+			r.Delete("/{name}", roleHandler.HandleDelete)
+		})
+	})
+
+	// Outbound feeds and sitemaps
+	syndicationHandler := NewSyndicationHandler(postService, site)
+	r.Get("/feed.rss", syndicationHandler.HandleRSS)
+	r.Get("/feed.atom", syndicationHandler.HandleAtom)
+	r.Get("/feed.json", syndicationHandler.HandleJSON)
+	sitemapHandler := NewSitemapHandler(postService, site)
+	r.Get("/sitemap.xml", sitemapHandler.HandleIndex)
+	r.Get("/sitemap-news.xml", sitemapHandler.HandleNews)
+	r.Get("/sitemap-posts-{page}.xml", sitemapHandler.HandlePage)
+
+	trendingHandler := NewTrendingHandler(NewStoryService(db))
+	r.Get("/trending", trendingHandler.HandleTrending)
+
 	// Feeds (for the parser)
 	feedHandler := NewFeedHandler(feedService)
 	r.Route("/feeds", func(r chi.Router) {
 		r.Get("/", feedHandler.HandleList)
 		r.Group(func(r chi.Router) {
-			r.Use(JWTAuthMiddleware(jwtManager))
-			r.Use(AdminOnlyMiddleware(userService))
+			r.Use(authn, can(PermFeedsManage))
 			r.Post("/", feedHandler.HandleCreate)
+			r.Get("/trash", feedHandler.HandleTrash)
+			r.Patch("/{id}", feedHandler.HandleUpdate)
 			r.Delete("/{id}", feedHandler.HandleDelete)
+			r.Post("/{id}/restore", feedHandler.HandleRestore)
 		})
 	})
 
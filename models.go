@@ -2,18 +2,35 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"errors"
+	"fmt"
+	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
 )
 
 // User
 
 type User struct {
-	ID           int64     `json:"id"`
-	Email        string    `json:"email"`
-	PasswordHash string    `json:"-"`
-	IsAdmin      bool      `json:"is_admin"`
-	CreatedAt    time.Time `json:"created_at"`
+	ID           int64      `json:"id"`
+	Email        string     `json:"email"`
+	PasswordHash string     `json:"-"`
+	Role         string     `json:"role"`
+	// IsAdmin is Role == "admin", kept for older clients.
+	IsAdmin      bool       `json:"is_admin"`
+	// DisabledAt is set while the account is blocked from logging in.
+	DisabledAt   *time.Time `json:"disabled_at,omitempty"`
+	// EmailVerifiedAt is nil until the user confirms their address; until
+	// then they have no permissions.
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
+	// TOTPEnabledAt is set while login requires a second factor.
+	TOTPEnabledAt *time.Time `json:"totp_enabled_at"`
+	CreatedAt    time.Time  `json:"created_at"`
+	DeletedAt    *time.Time `json:"deleted_at,omitempty"`
 }
 
 type UserService struct {
@@ -25,44 +42,211 @@ func NewUserService(db DB, hasher *PasswordHasher) *UserService {
 	return &UserService{db: db, passwordHasher: hasher}
 }
 
-func (s *UserService) GetByEmail(ctx context.Context, email string) (*User, error) {
-	row := s.db.QueryRowContext(ctx, "SELECT id, email, password_hash, is_admin, created_at FROM users WHERE email = $1", email)
+const userColumns = "id, email, password_hash, role, disabled_at, email_verified_at, totp_enabled_at, created_at, deleted_at"
+
+func scanUser(row rowScanner) (*User, error) {
 	u := &User{}
-	if err := row.Scan(&u.ID, &u.Email, &u.PasswordHash, &u.IsAdmin, &u.CreatedAt); err != nil {
+	if err := row.Scan(&u.ID, &u.Email, &u.PasswordHash, &u.Role, &u.DisabledAt, &u.EmailVerifiedAt, &u.TOTPEnabledAt, &u.CreatedAt, &u.DeletedAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) { return nil, ErrNotFound }
 		return nil, err
 	}
+	u.IsAdmin = u.Role == RoleAdmin
 	return u, nil
 }
 
+func (s *UserService) GetByEmail(ctx context.Context, email string) (*User, error) {
+	return scanUser(s.db.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users WHERE email = $1 AND deleted_at IS NULL", email))
+}
+
 func (s *UserService) GetByID(ctx context.Context, id int64) (*User, error) {
-	row := s.db.QueryRowContext(ctx, "SELECT id, email, password_hash, is_admin, created_at FROM users WHERE id = $1", id)
-	u := &User{}
-	if err := row.Scan(&u.ID, &u.Email, &u.PasswordHash, &u.IsAdmin, &u.CreatedAt); err != nil {
-		return nil, err
+	return scanUser(s.db.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users WHERE id = $1 AND deleted_at IS NULL", id))
+}
+
+// GetDeleted returns a user from the trash.
+func (s *UserService) GetDeleted(ctx context.Context, id int64) (*User, error) {
+	return scanUser(s.db.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users WHERE id = $1 AND deleted_at IS NOT NULL", id))
+}
+
+var (
+	ErrEmailTaken = errors.New("email is already taken")
+	// ErrLastAdmin keeps the last active admin from being deleted, disabled
+	// or demoted; ensureDefaultAdmin would otherwise recreate the default
+	// admin on the next start.
+	ErrLastAdmin = errors.New("cannot remove the last active admin")
+)
+
+const minPasswordLength = 8
+
+func validatePassword(password string) error {
+	if utf8.RuneCountInString(password) < minPasswordLength {
+		return fmt.Errorf("password must be at least %d characters", minPasswordLength)
 	}
-	return u, nil
+	return nil
+}
+
+func validEmail(email string) bool {
+	at := strings.IndexByte(email, '@')
+	return at > 0 && at < len(email)-1 && !strings.ContainsAny(email, " \t\r\n")
+}
+
+func emailTaken(ctx context.Context, q querier, email string, userID int64) (bool, error) {
+	var taken bool
+	err := q.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM users WHERE lower(email) = lower($1) AND id <> $2)", email, userID).Scan(&taken)
+	return taken, err
+}
+
+// Create adds a user on behalf of an admin; their email counts as verified.
+func (s *UserService) Create(ctx context.Context, email, password, role string) (*User, error) {
+	return s.create(ctx, email, password, role, true)
 }
 
-func (s *UserService) Create(ctx context.Context, email, password string, isAdmin bool) (*User, error) {
+func (s *UserService) create(ctx context.Context, email, password, role string, verified bool) (*User, error) {
+	email = strings.TrimSpace(email)
+	if !validEmail(email) { return nil, errors.New("invalid email") }
+	if err := validatePassword(password); err != nil { return nil, err }
 	hash, err := s.passwordHasher.HashPassword(password)
 	if err != nil { return nil, err }
 	var id int64
-	row := s.db.QueryRowContext(ctx, "INSERT INTO users (email, password_hash, is_admin) VALUES ($1, $2, $3) RETURNING id", email, hash, isAdmin)
-	if err := row.Scan(&id); err != nil { return nil, err }
+	err = withTx(ctx, s.db, func(tx *sql.Tx) error {
+		if taken, err := emailTaken(ctx, tx, email, 0); err != nil || taken {
+			if taken { return ErrEmailTaken }
+			return err
+		}
+		return tx.QueryRowContext(ctx, `INSERT INTO users (email, password_hash, role, is_admin, email_verified_at)
+			VALUES ($1, $2, $3, $3 = 'admin', CASE WHEN $4 THEN NOW() END) RETURNING id`, email, hash, role, verified).Scan(&id)
+	})
+	if err != nil { return nil, err }
+	return s.GetByID(ctx, id)
+}
+
+// UserUpdate lists the fields to change; nil fields are left alone.
+type UserUpdate struct {
+	Email    *string
+	Role     *string
+	Disabled *bool
+}
+
+// Update changes a user. Disabling a user ends their sessions. The is_admin
+// column is kept in step with the role for anything still reading it.
+func (s *UserService) Update(ctx context.Context, id int64, in UserUpdate) (*User, error) {
+	if in.Email != nil {
+		*in.Email = strings.TrimSpace(*in.Email)
+		if !validEmail(*in.Email) { return nil, errors.New("invalid email") }
+	}
+	err := withTx(ctx, s.db, func(tx *sql.Tx) error {
+		u, err := scanUser(tx.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users WHERE id = $1 AND deleted_at IS NULL FOR UPDATE", id))
+		if err != nil { return err }
+		demoted := in.Role != nil && *in.Role != RoleAdmin
+		disabled := in.Disabled != nil && *in.Disabled
+		if (demoted || disabled) && u.Role == RoleAdmin && u.DisabledAt == nil {
+			if err := ensureOtherAdmin(ctx, tx, id); err != nil { return err }
+		}
+		if in.Email != nil && *in.Email != u.Email {
+			if taken, err := emailTaken(ctx, tx, *in.Email, id); err != nil || taken {
+				if taken { return ErrEmailTaken }
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, "UPDATE users SET email = $1 WHERE id = $2", *in.Email, id); err != nil { return err }
+		}
+		if in.Role != nil {
+			if _, err := tx.ExecContext(ctx, "UPDATE users SET role = $1, is_admin = $1 = 'admin' WHERE id = $2", *in.Role, id); err != nil { return err }
+		}
+		if in.Disabled != nil && *in.Disabled != (u.DisabledAt != nil) {
+			if *in.Disabled {
+				if _, err := tx.ExecContext(ctx, "UPDATE users SET disabled_at = NOW() WHERE id = $1", id); err != nil { return err }
+				return revokeUserSessions(ctx, tx, id)
+			}
+			_, err := tx.ExecContext(ctx, "UPDATE users SET disabled_at = NULL WHERE id = $1", id)
+			return err
+		}
+		return nil
+	})
+	if err != nil { return nil, err }
 	return s.GetByID(ctx, id)
 }
 
+// SetPassword replaces the password of a user and ends their sessions.
+func (s *UserService) SetPassword(ctx context.Context, id int64, password string) error {
+	return s.setPasswordFor(ctx, password, func(*sql.Tx) (int64, error) { return id, nil })
+}
+
+// setPasswordFor validates and hashes password, then stores it for the user
+// picked by target and ends their sessions, all in one transaction.
+func (s *UserService) setPasswordFor(ctx context.Context, password string, target func(tx *sql.Tx) (int64, error)) error {
+	if err := validatePassword(password); err != nil { return err }
+	hash, err := s.passwordHasher.HashPassword(password)
+	if err != nil { return err }
+	return withTx(ctx, s.db, func(tx *sql.Tx) error {
+		id, err := target(tx)
+		if err != nil { return err }
+		res, err := tx.ExecContext(ctx, "UPDATE users SET password_hash = $1 WHERE id = $2 AND deleted_at IS NULL", hash, id)
+		if err != nil { return err }
+		if n, _ := res.RowsAffected(); n == 0 { return ErrNotFound }
+		return revokeUserSessions(ctx, tx, id)
+	})
+}
+
+// ensureOtherAdmin fails with ErrLastAdmin unless an active admin other
+// than id exists. It locks the admins so that concurrent demotions cannot
+// both pass.
+func ensureOtherAdmin(ctx context.Context, q querier, id int64) error {
+	rows, err := q.QueryContext(ctx, "SELECT id FROM users WHERE role = 'admin' AND deleted_at IS NULL AND disabled_at IS NULL ORDER BY id FOR UPDATE")
+	if err != nil { return err }
+	defer rows.Close()
+	for rows.Next() {
+		var other int64
+		if err := rows.Scan(&other); err != nil { return err }
+		if other != id { return nil }
+	}
+	if err := rows.Err(); err != nil { return err }
+	return ErrLastAdmin
+}
+
 func (s *UserService) List(ctx context.Context) ([]*User, error) {
-	rows, err := s.db.QueryContext(ctx, "SELECT id, email, password_hash, is_admin, created_at FROM users ORDER BY id DESC")
+	return s.list(ctx, "SELECT "+userColumns+" FROM users WHERE deleted_at IS NULL ORDER BY id DESC")
+}
+
+// ListDeleted returns the users in the trash, most recently deleted first.
+func (s *UserService) ListDeleted(ctx context.Context) ([]*User, error) {
+	return s.list(ctx, "SELECT "+userColumns+" FROM users WHERE deleted_at IS NOT NULL ORDER BY deleted_at DESC")
+}
+
+func (s *UserService) list(ctx context.Context, query string, args ...any) ([]*User, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
 	if err != nil { return nil, err }
 	defer rows.Close()
-	var users []*User
+	users := []*User{}
 	for rows.Next() {
-		u := &User{}
-		if err := rows.Scan(&u.ID, &u.Email, &u.PasswordHash, &u.IsAdmin, &u.CreatedAt); err != nil { return nil, err }
+		u, err := scanUser(rows)
+		if err != nil { return nil, err }
 		users = append(users, u)
 	}
-	return users, nil
+	return users, rows.Err()
+}
+
+// Delete moves a user to the trash, ending their sessions; Purge removes
+// them for good.
+func (s *UserService) Delete(ctx context.Context, id int64) error {
+	return withTx(ctx, s.db, func(tx *sql.Tx) error {
+		var role string
+		var disabledAt *time.Time
+		err := tx.QueryRowContext(ctx, "SELECT role, disabled_at FROM users WHERE id = $1 AND deleted_at IS NULL FOR UPDATE", id).Scan(&role, &disabledAt)
+		if errors.Is(err, sql.ErrNoRows) { return ErrNotFound }
+		if err != nil { return err }
+		if role == RoleAdmin && disabledAt == nil {
+			if err := ensureOtherAdmin(ctx, tx, id); err != nil { return err }
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE users SET deleted_at = NOW() WHERE id = $1", id); err != nil { return err }
+		return revokeUserSessions(ctx, tx, id)
+	})
+}
+
+func (s *UserService) Restore(ctx context.Context, id int64) error {
+	return restoreDeleted(ctx, s.db, "users", id)
+}
+
+func (s *UserService) Purge(ctx context.Context, before time.Time) (int64, error) {
+	return purgeDeleted(ctx, s.db, "users", before)
 }
 
 // Post
@@ -70,100 +254,825 @@ func (s *UserService) List(ctx context.Context) ([]*User, error) {
 type Post struct {
 	ID          int64      `json:"id"`
 	Title       string     `json:"title"`
-	Content     string     `json:"content"`
+	Slug        string     `json:"slug"`
+	// Content and ContentHTML are left out of excerpt-only listings.
+	Content     string     `json:"content,omitempty"`
+	// ContentFormat tells how Content is written; ContentHTML is its
+	// sanitized rendering, which clients should display.
+	ContentFormat string     `json:"content_format"`
+	ContentHTML   string     `json:"content_html,omitempty"`
+	Excerpt       string     `json:"excerpt"`
+	WordCount     int        `json:"word_count"`
+	// ReadingTime is the estimated reading time in minutes.
+	ReadingTime int `json:"reading_time"`
 	Source      *string    `json:"source,omitempty"`
+	FeedID      *int64     `json:"feed_id,omitempty"`
+	Author      *string    `json:"author,omitempty"`
+	AuthorID    *int64     `json:"author_id,omitempty"`
+	Status      string     `json:"status"`
+	PublishAt   *time.Time `json:"publish_at,omitempty"`
 	PublishedAt *time.Time `json:"published_at,omitempty"`
 	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	DeletedAt   *time.Time `json:"deleted_at,omitempty"`
+	// Version is bumped on every change and backs the post's ETag.
+	Version int `json:"version"`
+	Tags        []string   `json:"tags"`
+	// ClusterID is shared by near-duplicate posts (the same story from
+	// several feeds); it is the ID of the first post of the cluster.
+	ClusterID int64 `json:"cluster_id"`
+	// Keywords are the most prominent (stemmed) words of the post.
+	Keywords []string `json:"keywords"`
+	// StoryID groups posts about the same event, see assignStory.
+	StoryID *int64 `json:"story_id,omitempty"`
+	// AlsoReportedBy lists the other posts of the cluster in collapsed listings.
+	AlsoReportedBy []PostMention `json:"also_reported_by,omitempty"`
+	// Rank and Snippet are only filled in for search results.
+	Rank    float64 `json:"rank,omitempty"`
+	Snippet string  `json:"snippet,omitempty"`
+}
+
+// PostInput carries the writable fields of a post.
+type PostInput struct {
+	Title       string
+	// Slug is generated from Title when empty.
+	Slug        string
+	Content     string
+	// ContentFormat defaults to plain.
+	ContentFormat string
+	Source      *string
+	FeedID      *int64
+	Author      *string
+	AuthorID    *int64
+	PublishedAt *time.Time
+	Tags        []string
+	// Status defaults to published, or to scheduled when PublishAt is in the future.
+	Status    string
+	PublishAt *time.Time
+}
+
+// Post statuses. Only published posts are visible through the public API;
+// scheduled posts are published by StartPublisher once publish_at passes.
+const (
+	PostStatusDraft       = "draft"
+	PostStatusScheduled   = "scheduled"
+	PostStatusPublished   = "published"
+	PostStatusUnpublished = "unpublished"
+)
+
+func validPostStatus(s string) bool {
+	switch s {
+	case PostStatusDraft, PostStatusScheduled, PostStatusPublished, PostStatusUnpublished:
+		return true
+	}
+	return false
+}
+
+// resolvePostStatus applies the status defaults and checks that a
+// scheduled post has a publication time.
+func resolvePostStatus(status string, publishAt *time.Time) (string, error) {
+	if status == "" {
+		if publishAt != nil && publishAt.After(time.Now()) { return PostStatusScheduled, nil }
+		return PostStatusPublished, nil
+	}
+	if !validPostStatus(status) { return "", errors.New("invalid status") }
+	if status == PostStatusScheduled && publishAt == nil { return "", errors.New("scheduled posts require publish_at") }
+	return status, nil
 }
 
-type PostService struct { db DB }
+const postColumns = "p.id, p.title, COALESCE(p.slug, ''), p.content, p.content_format, COALESCE(p.content_html, ''), COALESCE(p.excerpt, ''), p.word_count, p.reading_time, p.source, p.feed_id, p.author, p.author_id, p.status, p.publish_at, p.published_at, p.created_at, p.updated_at, p.deleted_at, p.version, COALESCE(p.cluster_id, p.id), COALESCE(p.keywords, '{}'), p.story_id"
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanPost reads the postColumns of a row; extra receives any columns
+// selected after them.
+func scanPost(row rowScanner, extra ...any) (*Post, error) {
+	p := &Post{}
+	dest := []any{&p.ID, &p.Title, &p.Slug, &p.Content, &p.ContentFormat, &p.ContentHTML, &p.Excerpt, &p.WordCount, &p.ReadingTime, &p.Source, &p.FeedID, &p.Author, &p.AuthorID, &p.Status, &p.PublishAt, &p.PublishedAt, &p.CreatedAt, &p.UpdatedAt, &p.DeletedAt, &p.Version, &p.ClusterID, pq.Array(&p.Keywords), &p.StoryID}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+type PostService struct {
+	db DB
+	// onChange hooks run after posts are created, updated, published,
+	// deleted or restored.
+	onChange []func()
+}
 
 func NewPostService(db DB) *PostService { return &PostService{db: db} }
 
-func (s *PostService) Create(ctx context.Context, title, content string, source *string, publishedAt *time.Time) (*Post, error) {
+// OnChange registers fn to be called after every change to posts. Hooks
+// must be registered before the service is used.
+func (s *PostService) OnChange(fn func()) { s.onChange = append(s.onChange, fn) }
+
+func (s *PostService) changed() {
+	for _, fn := range s.onChange { fn() }
+}
+
+func (s *PostService) Create(ctx context.Context, in PostInput) (*Post, error) {
+	status, err := resolvePostStatus(in.Status, in.PublishAt)
+	if err != nil { return nil, err }
+	format := firstNonEmpty(in.ContentFormat, ContentFormatPlain)
+	d, err := derivePostFields(in.Title, format, in.Content)
+	if err != nil { return nil, err }
 	var id int64
-	row := s.db.QueryRowContext(ctx, "INSERT INTO posts (title, content, source, published_at) VALUES ($1, $2, $3, $4) RETURNING id", title, content, source, publishedAt)
-	if err := row.Scan(&id); err != nil { return nil, err }
+	insert := func(tx *sql.Tx) error {
+		slug, err := resolvePostSlug(ctx, tx, in.Slug, in.Title, 0)
+		if err != nil { return err }
+		var cluster int64
+		if d.Fingerprint != 0 {
+			if cluster, err = findPostCluster(ctx, tx, d.Fingerprint, 0); err != nil { return err }
+		}
+		row := tx.QueryRowContext(ctx, `INSERT INTO posts (title, slug, content, content_format, content_html, excerpt, word_count, reading_time,
+				fingerprint, fingerprint_bands, content_text, source, feed_id, author, author_id, status, publish_at, published_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $17, $18, $10, $11, $12, $13, $14, $15, CASE WHEN $14 = 'published' THEN COALESCE($16, NOW()) ELSE $16 END) RETURNING id`,
+			in.Title, slug, in.Content, format, d.ContentHTML, d.Excerpt, d.WordCount, d.ReadingTime,
+			d.Fingerprint, in.Source, in.FeedID, in.Author, in.AuthorID, status, in.PublishAt, in.PublishedAt, pq.Array(simhashBandKeys(d.Fingerprint)), d.Text)
+		if err := row.Scan(&id); err != nil { return err }
+		if cluster == 0 { cluster = id }
+		if _, err := tx.ExecContext(ctx, "UPDATE posts SET cluster_id = $1 WHERE id = $2", cluster, id); err != nil { return err }
+		keywords, err := updatePostKeywords(ctx, tx, id)
+		if err != nil { return err }
+		if err := assignStory(ctx, tx, id, cluster, in.Title, keywords); err != nil { return err }
+		if err := addPostRevision(ctx, tx, id, in.Title, in.Content, format, in.AuthorID); err != nil { return err }
+		return setPostTags(ctx, tx, id, in.Tags)
+	}
+	// Concurrent posts with the same title can pick the same slug; the loser
+	// retries and sees the winner's slug. A requested slug is simply taken.
+	for attempt := 1; ; attempt++ {
+		err = withTx(ctx, s.db, insert)
+		if !isSlugConflict(err) { break }
+		if in.Slug != "" || attempt == postSlugAttempts { return nil, ErrSlugTaken }
+	}
+	if err != nil { return nil, err }
+	s.changed()
 	return s.GetByID(ctx, id)
 }
 
-func (s *PostService) Update(ctx context.Context, id int64, title, content string) error {
-	_, err := s.db.ExecContext(ctx, "UPDATE posts SET title = $1, content = $2 WHERE id = $3", title, content, id)
-	return err
+// PostUpdate describes a change to a post. Empty Title, Content and Status
+// and nil Tags leave those fields unchanged; PublishAt is only applied along
+// with a Status. Source and PublishedAt are applied (nil clears them) only
+// when their Set flag is true. With SetSlug an empty Slug regenerates the
+// slug from the title; without it, a slug generated from the old title
+// follows title changes.
+type PostUpdate struct {
+	Title          string
+	SetSlug        bool
+	Slug           string
+	Content        string
+	ContentFormat  string
+	Tags           []string
+	Status         string
+	PublishAt      *time.Time
+	SetSource      bool
+	Source         *string
+	SetPublishedAt bool
+	PublishedAt    *time.Time
+	EditorID       *int64
+	// IfVersion makes the update conditional on the post still being at
+	// that version; 0 skips the check.
+	IfVersion int
 }
 
-func (s *PostService) Delete(ctx context.Context, id int64) error {
-	_, err := s.db.ExecContext(ctx, "DELETE FROM posts WHERE id = $1", id)
+// Update applies u to a post and bumps its version. A revision attributed
+// to u.EditorID is recorded when the title, content or its format changes.
+func (s *PostService) Update(ctx context.Context, id int64, u PostUpdate) (*Post, error) {
+	err := withTx(ctx, s.db, func(tx *sql.Tx) error {
+		p, err := scanPost(tx.QueryRowContext(ctx, "SELECT "+postColumns+" FROM posts p WHERE p.id = $1 AND p.deleted_at IS NULL FOR UPDATE", id))
+		if errors.Is(err, sql.ErrNoRows) { return ErrNotFound }
+		if err != nil { return err }
+		if u.IfVersion != 0 && u.IfVersion != p.Version { return ErrVersionMismatch }
+		title, content := firstNonEmpty(u.Title, p.Title), firstNonEmpty(u.Content, p.Content)
+		format := firstNonEmpty(u.ContentFormat, p.ContentFormat)
+		d, err := derivePostFields(title, format, content)
+		if err != nil { return err }
+		status, publishAt := p.Status, p.PublishAt
+		if u.Status != "" {
+			if !validPostStatus(u.Status) { return errors.New("invalid status") }
+			if u.Status == PostStatusScheduled && u.PublishAt == nil { return errors.New("scheduled posts require publish_at") }
+			status, publishAt = u.Status, u.PublishAt
+		}
+		source, publishedAt := p.Source, p.PublishedAt
+		if u.SetSource { source = u.Source }
+		if u.SetPublishedAt { publishedAt = u.PublishedAt }
+		slug := p.Slug
+		switch {
+		case u.SetSlug && u.Slug != p.Slug, p.Slug == "":
+			slug, err = resolvePostSlug(ctx, tx, u.Slug, title, id)
+		case !u.SetSlug && title != p.Title && isAutoSlug(p.Slug, p.Title):
+			slug, err = uniquePostSlug(ctx, tx, title, id)
+		}
+		if err != nil { return err }
+		if err := changePostSlug(ctx, tx, id, p.Slug, slug); err != nil { return err }
+		_, err = tx.ExecContext(ctx, `UPDATE posts SET title = $1, content = $2, status = $3, publish_at = $4, source = $5,
+			published_at = CASE WHEN $3 = 'published' THEN COALESCE($6, NOW()) ELSE $6 END,
+			content_format = $7, content_html = $8, excerpt = $9, word_count = $10, reading_time = $11, slug = $12,
+			fingerprint = $13, fingerprint_bands = $15, content_text = $16, version = version + 1, updated_at = NOW()
+			WHERE id = $14`, title, content, status, publishAt, source, publishedAt, format, d.ContentHTML, d.Excerpt, d.WordCount, d.ReadingTime, slug,
+			d.Fingerprint, id, pq.Array(simhashBandKeys(d.Fingerprint)), d.Text)
+		if err != nil { return err }
+		if title != p.Title || content != p.Content || format != p.ContentFormat {
+			if err := addPostRevision(ctx, tx, id, title, content, format, u.EditorID); err != nil { return err }
+			if _, err := updatePostKeywords(ctx, tx, id); err != nil { return err }
+		}
+		if u.Tags == nil { return nil }
+		return setPostTags(ctx, tx, id, u.Tags)
+	})
+	if err != nil { return nil, err }
+	s.changed()
+	return s.GetByID(ctx, id)
+}
+
+// addPostRevision appends the next revision of a post. Callers hold the
+// post row lock (or just inserted it), so revision numbers cannot collide.
+func addPostRevision(ctx context.Context, q querier, postID int64, title, content, format string, editorID *int64) error {
+	_, err := q.ExecContext(ctx, `INSERT INTO post_revisions (post_id, rev, title, content, content_format, editor_id)
+		SELECT $1, COALESCE(MAX(rev), 0) + 1, $2, $3, $4, $5 FROM post_revisions WHERE post_id = $1`, postID, title, content, format, editorID)
 	return err
 }
 
-func (s *PostService) GetByID(ctx context.Context, id int64) (*Post, error) {
-	row := s.db.QueryRowContext(ctx, "SELECT id, title, content, source, published_at, created_at FROM posts WHERE id = $1", id)
-	p := &Post{}
-	if err := row.Scan(&p.ID, &p.Title, &p.Content, &p.Source, &p.PublishedAt, &p.CreatedAt); err != nil {
-		return nil, err
+// FirstCreatedAt returns when the oldest post, trashed ones included, was
+// created, or the current time if there are no posts yet.
+func (s *PostService) FirstCreatedAt(ctx context.Context) (time.Time, error) {
+	var t sql.NullTime
+	if err := s.db.QueryRowContext(ctx, "SELECT MIN(created_at) FROM posts").Scan(&t); err != nil { return time.Time{}, err }
+	if !t.Valid { return time.Now(), nil }
+	return t.Time, nil
+}
+
+// PublishDue publishes scheduled posts whose publish_at has passed and
+// returns how many were published.
+func (s *PostService) PublishDue(ctx context.Context) (int64, error) {
+	res, err := s.db.ExecContext(ctx, `UPDATE posts SET status = 'published', published_at = COALESCE(published_at, publish_at),
+		version = version + 1, updated_at = NOW()
+		WHERE status = 'scheduled' AND publish_at <= NOW() AND deleted_at IS NULL`)
+	if err != nil { return 0, err }
+	n, err := res.RowsAffected()
+	if n > 0 { s.changed() }
+	return n, err
+}
+
+// Delete moves a post to the trash; Purge removes it for good. A non-zero
+// ifVersion makes the deletion conditional like PostUpdate.IfVersion.
+func (s *PostService) Delete(ctx context.Context, id int64, ifVersion int) error {
+	if ifVersion == 0 {
+		if err := softDelete(ctx, s.db, "posts", id); err != nil { return err }
+		s.changed()
+		return nil
 	}
-	return p, nil
+	res, err := s.db.ExecContext(ctx, "UPDATE posts SET deleted_at = NOW() WHERE id = $1 AND deleted_at IS NULL AND version = $2", id, ifVersion)
+	if err != nil { return err }
+	if n, _ := res.RowsAffected(); n > 0 { s.changed(); return nil }
+	if _, err := s.GetByID(ctx, id); err != nil { return err }
+	return ErrVersionMismatch
+}
+
+func (s *PostService) Restore(ctx context.Context, id int64) error {
+	if err := restoreDeleted(ctx, s.db, "posts", id); err != nil { return err }
+	s.changed()
+	return nil
+}
+
+func (s *PostService) Purge(ctx context.Context, before time.Time) (int64, error) {
+	return purgeDeleted(ctx, s.db, "posts", before)
+}
+
+// AuthorOf returns the user who created a post, trashed posts included.
+func (s *PostService) AuthorOf(ctx context.Context, id int64) (*int64, error) {
+	var author *int64
+	err := s.db.QueryRowContext(ctx, "SELECT author_id FROM posts WHERE id = $1", id).Scan(&author)
+	if errors.Is(err, sql.ErrNoRows) { return nil, ErrNotFound }
+	return author, err
 }
 
-func (s *PostService) List(ctx context.Context, limit, offset int) ([]*Post, error) {
-	rows, err := s.db.QueryContext(ctx, "SELECT id, title, content, source, published_at, created_at FROM posts ORDER BY id DESC LIMIT $1 OFFSET $2", limit, offset)
+func (s *PostService) GetByID(ctx context.Context, id int64) (*Post, error) {
+	p, err := scanPost(s.db.QueryRowContext(ctx, "SELECT "+postColumns+" FROM posts p WHERE p.id = $1 AND p.deleted_at IS NULL", id))
+	if errors.Is(err, sql.ErrNoRows) { return nil, ErrNotFound }
 	if err != nil { return nil, err }
+	if err := s.attachTags(ctx, []*Post{p}); err != nil { return nil, err }
+	return p, nil
+}
+
+// GetBySlug returns the post a slug belongs to. For a former slug of a post
+// it returns ErrNotFound along with the post's current slug.
+func (s *PostService) GetBySlug(ctx context.Context, slug string) (*Post, string, error) {
+	p, err := scanPost(s.db.QueryRowContext(ctx, "SELECT "+postColumns+" FROM posts p WHERE p.slug = $1 AND p.deleted_at IS NULL", slug))
+	if errors.Is(err, sql.ErrNoRows) {
+		var current string
+		err = s.db.QueryRowContext(ctx, `SELECT p.slug FROM post_slug_redirects r JOIN posts p ON p.id = r.post_id
+			WHERE r.slug = $1 AND p.deleted_at IS NULL AND p.slug IS NOT NULL`, slug).Scan(&current)
+		if errors.Is(err, sql.ErrNoRows) { return nil, "", ErrNotFound }
+		if err != nil { return nil, "", err }
+		return nil, current, ErrNotFound
+	}
+	if err != nil { return nil, "", err }
+	if err := s.attachTags(ctx, []*Post{p}); err != nil { return nil, "", err }
+	return p, "", nil
+}
+
+// attachTags fills in the tag slugs of posts with a single query.
+func (s *PostService) attachTags(ctx context.Context, posts []*Post) error {
+	if len(posts) == 0 { return nil }
+	byID := make(map[int64]*Post, len(posts))
+	ids := make([]int64, 0, len(posts))
+	for _, p := range posts {
+		p.Tags = []string{}
+		byID[p.ID] = p
+		ids = append(ids, p.ID)
+	}
+	rows, err := s.db.QueryContext(ctx, "SELECT pt.post_id, t.slug FROM post_tags pt JOIN tags t ON t.id = pt.tag_id WHERE pt.post_id = ANY($1) ORDER BY t.slug", pq.Array(ids))
+	if err != nil { return err }
+	defer rows.Close()
+	for rows.Next() {
+		var postID int64
+		var slug string
+		if err := rows.Scan(&postID, &slug); err != nil { return err }
+		byID[postID].Tags = append(byID[postID].Tags, slug)
+	}
+	return rows.Err()
+}
+
+// List returns one page of posts matching params together with the cursor
+// of the next page, which is empty when there are no more posts.
+func (s *PostService) List(ctx context.Context, params PostListParams) ([]*Post, string, error) {
+	q := &queryBuilder{}
+	from := "posts p"
+	cols := postColumns
+	if params.Query != "" {
+		from += searchFrom(q, params.Query)
+		cols += ", " + searchRankExpr(params.Lang) + ", " + searchSnippetExpr(params.Lang)
+	}
+	params.applyFilters(q, "p")
+	if params.Collapse {
+		// A post is listed unless an older post of its cluster also matches.
+		sub := &queryBuilder{args: q.args}
+		params.applyFilters(sub, "o")
+		q.args = sub.args
+		q.where("NOT EXISTS (SELECT 1 FROM posts o WHERE o.cluster_id = p.cluster_id AND o.id < p.id AND " + strings.Join(sub.conds, " AND ") + ")")
+	}
+	key := params.keyExpr()
+	if c := params.Cursor; c != nil {
+		op := "<"
+		if !params.Sort.desc() { op = ">" }
+		var v any = c.Time
+		if params.Sort == SortRank { v = c.Rank }
+		q.where("("+key+", p.id) "+op+" (?, ?)", v, c.ID)
+	}
+	dir := "DESC"
+	if !params.Sort.desc() { dir = "ASC" }
+	query := "SELECT " + cols + ", " + key + " FROM " + from + q.whereClause() +
+		" ORDER BY " + key + " " + dir + ", p.id " + dir + " LIMIT " + q.arg(params.Limit+1)
+	rows, err := s.db.QueryContext(ctx, query, q.args...)
+	if err != nil { return nil, "", err }
 	defer rows.Close()
 	var posts []*Post
+	var cursors []postCursor
+	for rows.Next() {
+		c := postCursor{Sort: params.Sort}
+		var rank float64
+		var snippet string
+		extra := []any{sortKeyDest(&c)}
+		if params.Query != "" { extra = []any{&rank, &snippet, sortKeyDest(&c)} }
+		p, err := scanPost(rows, extra...)
+		if err != nil { return nil, "", err }
+		p.Rank, p.Snippet = rank, snippet
+		c.ID = p.ID
+		posts = append(posts, p)
+		cursors = append(cursors, c)
+	}
+	if err := rows.Err(); err != nil { return nil, "", err }
+	next := ""
+	if len(posts) > params.Limit {
+		posts = posts[:params.Limit]
+		next = cursors[params.Limit-1].encode()
+	}
+	if err := s.attachTags(ctx, posts); err != nil { return nil, "", err }
+	if params.Collapse {
+		if err := s.attachMentions(ctx, posts, params.Statuses); err != nil { return nil, "", err }
+	}
+	return posts, next, nil
+}
+
+// Related returns published posts similar to post id, best first: each
+// shared tag counts 2, the same feed 0.5, and text similarity up to about
+// 1 (ts_rank of the post's keywords, scaled). The post's own cluster of
+// near-duplicates is left out.
+func (s *PostService) Related(ctx context.Context, id int64, limit int) ([]*Post, error) {
+	rows, err := s.db.QueryContext(ctx, `WITH src AS (
+			SELECT id, feed_id, COALESCE(cluster_id, id) AS cluster_id,
+				(SELECT string_agg(quote_literal(k), ' | ') FROM unnest(keywords) k)::tsquery AS q
+			FROM posts WHERE id = $1
+		), scored AS (
+			SELECT p.id, 2 * (SELECT COUNT(*) FROM post_tags a JOIN post_tags b ON b.tag_id = a.tag_id WHERE a.post_id = src.id AND b.post_id = p.id)
+				+ CASE WHEN p.feed_id = src.feed_id THEN 0.5 ELSE 0 END
+				+ COALESCE(10 * ts_rank(p.search_ru, src.q), 0) AS score
+			FROM posts p, src
+			WHERE p.id <> src.id AND COALESCE(p.cluster_id, p.id) <> src.cluster_id
+				AND p.status = 'published' AND p.deleted_at IS NULL
+				AND (p.search_ru @@ src.q OR EXISTS (SELECT 1 FROM post_tags a JOIN post_tags b ON b.tag_id = a.tag_id WHERE a.post_id = src.id AND b.post_id = p.id))
+		)
+		SELECT `+postColumns+`, scored.score FROM scored JOIN posts p ON p.id = scored.id
+		ORDER BY scored.score DESC, COALESCE(p.published_at, p.created_at) DESC, p.id DESC LIMIT $2`, id, limit)
+	if err != nil { return nil, err }
+	defer rows.Close()
+	posts := []*Post{}
 	for rows.Next() {
-		p := &Post{}
-		if err := rows.Scan(&p.ID, &p.Title, &p.Content, &p.Source, &p.PublishedAt, &p.CreatedAt); err != nil { return nil, err }
+		var score float64
+		p, err := scanPost(rows, &score)
+		if err != nil { return nil, err }
+		p.Rank = score
 		posts = append(posts, p)
 	}
+	if err := rows.Err(); err != nil { return nil, err }
+	if err := s.attachTags(ctx, posts); err != nil { return nil, err }
 	return posts, nil
 }
 
-// Feed
+// PostMention is another post of the same cluster.
+type PostMention struct {
+	ID     int64   `json:"id"`
+	Title  string  `json:"title"`
+	FeedID *int64  `json:"feed_id,omitempty"`
+	Source *string `json:"source,omitempty"`
+}
 
-type Feed struct {
+// attachMentions fills in AlsoReportedBy with the other live posts of each
+// post's cluster that are in one of statuses (any status if empty).
+func (s *PostService) attachMentions(ctx context.Context, posts []*Post, statuses []string) error {
+	if len(posts) == 0 { return nil }
+	byCluster := make(map[int64]*Post, len(posts))
+	clusters := make([]int64, 0, len(posts))
+	for _, p := range posts {
+		byCluster[p.ClusterID] = p
+		clusters = append(clusters, p.ClusterID)
+	}
+	rows, err := s.db.QueryContext(ctx, `SELECT cluster_id, id, title, feed_id, source FROM posts
+		WHERE cluster_id = ANY($1) AND deleted_at IS NULL AND (COALESCE(cardinality($2::text[]), 0) = 0 OR status = ANY($2))
+		ORDER BY id`, pq.Array(clusters), pq.Array(statuses))
+	if err != nil { return err }
+	defer rows.Close()
+	for rows.Next() {
+		var cluster int64
+		var m PostMention
+		if err := rows.Scan(&cluster, &m.ID, &m.Title, &m.FeedID, &m.Source); err != nil { return err }
+		if p := byCluster[cluster]; p != nil && p.ID != m.ID { p.AlsoReportedBy = append(p.AlsoReportedBy, m) }
+	}
+	return rows.Err()
+}
+
+// sortKeyDest returns where the sort key column of a listing row is scanned to.
+func sortKeyDest(c *postCursor) any {
+	if c.Sort == SortRank { return &c.Rank }
+	return &c.Time
+}
+
+// PostRevision is a snapshot of a post's title and content.
+
+type PostRevision struct {
+	PostID    int64     `json:"post_id"`
+	Rev       int       `json:"rev"`
+	Title     string    `json:"title"`
+	Content   string    `json:"content,omitempty"`
+	ContentFormat string `json:"content_format,omitempty"`
+	EditorID  *int64    `json:"editor_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ListRevisions returns the history of a post, newest first, without content.
+func (s *PostService) ListRevisions(ctx context.Context, postID int64) ([]*PostRevision, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT post_id, rev, title, editor_id, created_at FROM post_revisions WHERE post_id = $1 ORDER BY rev DESC", postID)
+	if err != nil { return nil, err }
+	defer rows.Close()
+	revs := []*PostRevision{}
+	for rows.Next() {
+		r := &PostRevision{}
+		if err := rows.Scan(&r.PostID, &r.Rev, &r.Title, &r.EditorID, &r.CreatedAt); err != nil { return nil, err }
+		revs = append(revs, r)
+	}
+	if err := rows.Err(); err != nil { return nil, err }
+	if len(revs) == 0 { return nil, ErrNotFound }
+	return revs, nil
+}
+
+func (s *PostService) GetRevision(ctx context.Context, postID int64, rev int) (*PostRevision, error) {
+	r := &PostRevision{}
+	err := s.db.QueryRowContext(ctx, "SELECT post_id, rev, title, content, content_format, editor_id, created_at FROM post_revisions WHERE post_id = $1 AND rev = $2", postID, rev).
+		Scan(&r.PostID, &r.Rev, &r.Title, &r.Content, &r.ContentFormat, &r.EditorID, &r.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) { return nil, ErrNotFound }
+	if err != nil { return nil, err }
+	return r, nil
+}
+
+// RestoreRevision brings back the title and content of rev as a new revision.
+func (s *PostService) RestoreRevision(ctx context.Context, postID int64, rev int, editorID *int64) (*Post, error) {
+	r, err := s.GetRevision(ctx, postID, rev)
+	if err != nil { return nil, err }
+	return s.Update(ctx, postID, PostUpdate{Title: r.Title, Content: r.Content, ContentFormat: r.ContentFormat, EditorID: editorID})
+}
+
+// Tag
+
+type Tag struct {
 	ID        int64     `json:"id"`
-	URL       string    `json:"url"`
-	Enabled   bool      `json:"enabled"`
+	Slug      string    `json:"slug"`
+	Name      string    `json:"name"`
+	Aliases   []string  `json:"aliases"`
+	PostCount int64     `json:"post_count"`
 	CreatedAt time.Time `json:"created_at"`
 }
 
+const (
+	maxTagLen   = 64
+	maxPostTags = 20
+)
+
+// normalizeTagSlug lowercases a tag name and collapses everything that is
+// not a letter or digit into single dashes, so "Go", " go " and "GO!" share
+// the slug "go". Cyrillic letters are kept as they are.
+func normalizeTagSlug(name string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(strings.TrimSpace(name)) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if dash && b.Len() > 0 { b.WriteByte('-') }
+			dash = false
+			b.WriteRune(r)
+			continue
+		}
+		dash = true
+	}
+	slug := []rune(b.String())
+	if len(slug) > maxTagLen { slug = slug[:maxTagLen] }
+	return strings.Trim(string(slug), "-")
+}
+
+// distinctPostTags drops blank tag names and repeated spellings of the
+// same tag from names, keeping the first one. Limits on the number of tags
+// of a post apply to what is left.
+func distinctPostTags(names []string) []string {
+	seen := map[string]bool{}
+	var out []string
+	for _, name := range names {
+		slug := normalizeTagSlug(name)
+		if slug == "" || seen[slug] { continue }
+		seen[slug] = true
+		out = append(out, name)
+	}
+	return out
+}
+
+// feedPostTags turns the categories of a feed item into post tags. Feeds
+// are not refused for having too many, they lose the ones after
+// maxPostTags instead.
+func feedPostTags(categories []string) []string {
+	tags := distinctPostTags(categories)
+	if len(tags) > maxPostTags { tags = tags[:maxPostTags] }
+	return tags
+}
+
+// resolveTag returns the ID of the tag a name refers to, following aliases
+// and creating the tag on first use.
+func resolveTag(ctx context.Context, q querier, name string) (int64, error) {
+	slug := normalizeTagSlug(name)
+	var id int64
+	err := q.QueryRowContext(ctx, "SELECT tag_id FROM tag_aliases WHERE slug = $1", slug).Scan(&id)
+	if err == nil { return id, nil }
+	if !errors.Is(err, sql.ErrNoRows) { return 0, err }
+	err = q.QueryRowContext(ctx, "INSERT INTO tags (slug, name) VALUES ($1, $2) ON CONFLICT (slug) DO UPDATE SET slug = EXCLUDED.slug RETURNING id", slug, strings.TrimSpace(name)).Scan(&id)
+	return id, err
+}
+
+// setPostTags replaces the tags of a post; blank names are ignored.
+func setPostTags(ctx context.Context, q querier, postID int64, names []string) error {
+	if _, err := q.ExecContext(ctx, "DELETE FROM post_tags WHERE post_id = $1", postID); err != nil {
+		return err
+	}
+	for _, name := range names {
+		if normalizeTagSlug(name) == "" { continue }
+		tagID, err := resolveTag(ctx, q, name)
+		if err != nil { return err }
+		if _, err := q.ExecContext(ctx, "INSERT INTO post_tags (post_id, tag_id) VALUES ($1, $2) ON CONFLICT DO NOTHING", postID, tagID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type TagService struct { db DB }
+
+func NewTagService(db DB) *TagService { return &TagService{db: db} }
+
+const tagColumns = `t.id, t.slug, t.name, t.created_at,
+	COALESCE((SELECT array_agg(a.slug ORDER BY a.slug) FROM tag_aliases a WHERE a.tag_id = t.id), '{}'),
+	(SELECT COUNT(1) FROM post_tags pt JOIN posts p ON p.id = pt.post_id WHERE pt.tag_id = t.id AND p.status = 'published' AND p.deleted_at IS NULL)`
+
+func scanTag(row rowScanner) (*Tag, error) {
+	t := &Tag{}
+	if err := row.Scan(&t.ID, &t.Slug, &t.Name, &t.CreatedAt, pq.Array(&t.Aliases), &t.PostCount); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// List returns all tags, most used first. Counts only include published posts.
+func (s *TagService) List(ctx context.Context) ([]*Tag, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT "+tagColumns+" FROM tags t ORDER BY 6 DESC, t.slug")
+	if err != nil { return nil, err }
+	defer rows.Close()
+	tags := []*Tag{}
+	for rows.Next() {
+		t, err := scanTag(rows)
+		if err != nil { return nil, err }
+		tags = append(tags, t)
+	}
+	return tags, rows.Err()
+}
+
+// GetBySlug finds a tag by its slug or one of its aliases.
+func (s *TagService) GetBySlug(ctx context.Context, slug string) (*Tag, error) {
+	slug = normalizeTagSlug(slug)
+	t, err := scanTag(s.db.QueryRowContext(ctx, "SELECT "+tagColumns+" FROM tags t WHERE t.slug = $1 OR t.id = (SELECT tag_id FROM tag_aliases WHERE slug = $1)", slug))
+	if errors.Is(err, sql.ErrNoRows) { return nil, ErrNotFound }
+	return t, err
+}
+
+// Merge folds the tag from into the tag into: posts are retagged and the
+// slug of from (with its aliases) becomes an alias of into, so later
+// ingestion of the old name lands on the merged tag.
+func (s *TagService) Merge(ctx context.Context, from, into string) (*Tag, error) {
+	src, err := s.GetBySlug(ctx, from)
+	if err != nil { return nil, err }
+	dst, err := s.GetBySlug(ctx, into)
+	if err != nil { return nil, err }
+	if src.ID == dst.ID { return nil, errors.New("cannot merge a tag into itself") }
+	err = withTx(ctx, s.db, func(tx *sql.Tx) error {
+		stmts := []struct {
+			query string
+			args  []any
+		}{
+			{touchTaggedPosts, []any{src.ID}},
+			{"INSERT INTO post_tags (post_id, tag_id) SELECT post_id, $2 FROM post_tags WHERE tag_id = $1 ON CONFLICT DO NOTHING", []any{src.ID, dst.ID}},
+			{"UPDATE tag_aliases SET tag_id = $2 WHERE tag_id = $1", []any{src.ID, dst.ID}},
+			{"DELETE FROM tags WHERE id = $1", []any{src.ID}},
+			{"INSERT INTO tag_aliases (slug, tag_id) VALUES ($1, $2)", []any{src.Slug, dst.ID}},
+		}
+		for _, st := range stmts {
+			if _, err := tx.ExecContext(ctx, st.query, st.args...); err != nil { return err }
+		}
+		return nil
+	})
+	if err != nil { return nil, err }
+	return s.GetBySlug(ctx, dst.Slug)
+}
+
+// AddAlias makes alias resolve to the tag slug. The alias must not be a tag
+// of its own; merge such tags instead.
+func (s *TagService) AddAlias(ctx context.Context, slug, alias string) (*Tag, error) {
+	t, err := s.GetBySlug(ctx, slug)
+	if err != nil { return nil, err }
+	alias = normalizeTagSlug(alias)
+	if alias == "" { return nil, errors.New("invalid alias") }
+	var exists bool
+	if err := s.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM tags WHERE slug = $1)", alias).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if exists { return nil, errors.New("alias is an existing tag; merge it instead") }
+	if _, err := s.db.ExecContext(ctx, "INSERT INTO tag_aliases (slug, tag_id) VALUES ($1, $2) ON CONFLICT (slug) DO UPDATE SET tag_id = EXCLUDED.tag_id", alias, t.ID); err != nil {
+		return nil, err
+	}
+	return s.GetBySlug(ctx, t.Slug)
+}
+
+func (s *TagService) Delete(ctx context.Context, slug string) error {
+	t, err := s.GetBySlug(ctx, slug)
+	if err != nil { return err }
+	return withTx(ctx, s.db, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, touchTaggedPosts, t.ID); err != nil { return err }
+		_, err := tx.ExecContext(ctx, "DELETE FROM tags WHERE id = $1", t.ID)
+		return err
+	})
+}
+
+// touchTaggedPosts bumps the version of every post carrying tag $1, whose
+// representation is about to change.
+const touchTaggedPosts = "UPDATE posts SET version = version + 1, updated_at = NOW() WHERE id IN (SELECT post_id FROM post_tags WHERE tag_id = $1)"
+
+// Feed
+
+type Feed struct {
+	ID        int64      `json:"id"`
+	URL       string     `json:"url"`
+	// Group is a free-form label for filtering posts by a set of feeds.
+	Group     *string    `json:"group,omitempty"`
+	Enabled   bool       `json:"enabled"`
+	CreatedAt time.Time  `json:"created_at"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
 type FeedService struct { db DB }
 
 func NewFeedService(db DB) *FeedService { return &FeedService{db: db} }
 
-func (s *FeedService) Create(ctx context.Context, url string) (*Feed, error) {
+const feedColumns = "id, url, group_name, enabled, created_at, deleted_at"
+
+func scanFeed(row rowScanner) (*Feed, error) {
+	f := &Feed{}
+	if err := row.Scan(&f.ID, &f.URL, &f.Group, &f.Enabled, &f.CreatedAt, &f.DeletedAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) { return nil, ErrNotFound }
+		return nil, err
+	}
+	return f, nil
+}
+
+// Create adds a feed. Re-adding the URL of a feed in the trash restores it.
+func (s *FeedService) Create(ctx context.Context, url string, group *string) (*Feed, error) {
 	var id int64
-	row := s.db.QueryRowContext(ctx, "INSERT INTO feeds (url, enabled) VALUES ($1, TRUE) RETURNING id", url)
-	if err := row.Scan(&id); err != nil { return nil, err }
+	row := s.db.QueryRowContext(ctx, `INSERT INTO feeds (url, group_name, enabled) VALUES ($1, $2, TRUE)
+		ON CONFLICT (url) DO UPDATE SET deleted_at = NULL, enabled = TRUE, group_name = EXCLUDED.group_name WHERE feeds.deleted_at IS NOT NULL
+		RETURNING id`, url, group)
+	if err := row.Scan(&id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) { return nil, errors.New("feed already exists") }
+		return nil, err
+	}
+	return s.GetByID(ctx, id)
+}
+
+// SetGroup moves a feed into a group; nil ungroups it.
+func (s *FeedService) SetGroup(ctx context.Context, id int64, group *string) (*Feed, error) {
+	res, err := s.db.ExecContext(ctx, "UPDATE feeds SET group_name = $1 WHERE id = $2 AND deleted_at IS NULL", group, id)
+	if err != nil { return nil, err }
+	if n, _ := res.RowsAffected(); n == 0 { return nil, ErrNotFound }
 	return s.GetByID(ctx, id)
 }
 
+// Delete moves a feed to the trash; Purge removes it for good.
 func (s *FeedService) Delete(ctx context.Context, id int64) error {
-	_, err := s.db.ExecContext(ctx, "DELETE FROM feeds WHERE id = $1", id)
-	return err
+	return softDelete(ctx, s.db, "feeds", id)
+}
+
+func (s *FeedService) Restore(ctx context.Context, id int64) error {
+	return restoreDeleted(ctx, s.db, "feeds", id)
+}
+
+func (s *FeedService) Purge(ctx context.Context, before time.Time) (int64, error) {
+	return purgeDeleted(ctx, s.db, "feeds", before)
 }
 
 func (s *FeedService) List(ctx context.Context) ([]*Feed, error) {
-	rows, err := s.db.QueryContext(ctx, "SELECT id, url, enabled, created_at FROM feeds WHERE enabled = TRUE ORDER BY id DESC")
+	return s.list(ctx, "SELECT "+feedColumns+" FROM feeds WHERE enabled = TRUE AND deleted_at IS NULL ORDER BY id DESC")
+}
+
+// ListDeleted returns the feeds in the trash, most recently deleted first.
+func (s *FeedService) ListDeleted(ctx context.Context) ([]*Feed, error) {
+	return s.list(ctx, "SELECT "+feedColumns+" FROM feeds WHERE deleted_at IS NOT NULL ORDER BY deleted_at DESC")
+}
+
+func (s *FeedService) list(ctx context.Context, query string, args ...any) ([]*Feed, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
 	if err != nil { return nil, err }
 	defer rows.Close()
-	var feeds []*Feed
+	feeds := []*Feed{}
 	for rows.Next() {
-		f := &Feed{}
-		if err := rows.Scan(&f.ID, &f.URL, &f.Enabled, &f.CreatedAt); err != nil { return nil, err }
+		f, err := scanFeed(rows)
+		if err != nil { return nil, err }
 		feeds = append(feeds, f)
 	}
-	return feeds, nil
+	return feeds, rows.Err()
 }
 
 func (s *FeedService) GetByID(ctx context.Context, id int64) (*Feed, error) {
-	row := s.db.QueryRowContext(ctx, "SELECT id, url, enabled, created_at FROM feeds WHERE id = $1", id)
-	f := &Feed{}
-	if err := row.Scan(&f.ID, &f.URL, &f.Enabled, &f.CreatedAt); err != nil {
-		return nil, err
-	}
-	return f, nil
+	return scanFeed(s.db.QueryRowContext(ctx, "SELECT "+feedColumns+" FROM feeds WHERE id = $1 AND deleted_at IS NULL", id))
+}
+
+// Trash helpers shared by the soft-deletable tables. table is always a
+// constant supplied by the services, never user input.
+
+func softDelete(ctx context.Context, db DB, table string, id int64) error {
+	res, err := db.ExecContext(ctx, "UPDATE "+table+" SET deleted_at = NOW() WHERE id = $1 AND deleted_at IS NULL", id)
+	if err != nil { return err }
+	if n, _ := res.RowsAffected(); n == 0 { return ErrNotFound }
+	return nil
+}
+
+func restoreDeleted(ctx context.Context, db DB, table string, id int64) error {
+	res, err := db.ExecContext(ctx, "UPDATE "+table+" SET deleted_at = NULL WHERE id = $1 AND deleted_at IS NOT NULL", id)
+	if err != nil { return err }
+	if n, _ := res.RowsAffected(); n == 0 { return ErrNotFound }
+	return nil
 }
 
-var ErrNotFound = errors.New("not found")
\ No newline at end of file
+func purgeDeleted(ctx context.Context, db DB, table string, before time.Time) (int64, error) {
+	res, err := db.ExecContext(ctx, "DELETE FROM "+table+" WHERE deleted_at IS NOT NULL AND deleted_at < $1", before)
+	if err != nil { return 0, err }
+	return res.RowsAffected()
+}
+
+var ErrNotFound = errors.New("not found")
+
+// ErrVersionMismatch reports a conditional write against a stale version.
+var ErrVersionMismatch = errors.New("version mismatch")
\ No newline at end of file
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestDistinctPostTags(t *testing.T) {
+	tests := []struct {
+		in, want []string
+	}{
+		{nil, nil},
+		{[]string{"", "  ", "!!!"}, nil},
+		{[]string{"Go", "go", " GO! ", "Golang"}, []string{"Go", "Golang"}},
+		{[]string{"Экономика", "экономика", "Спорт"}, []string{"Экономика", "Спорт"}},
+		{[]string{"machine learning", "Machine-Learning"}, []string{"machine learning"}},
+	}
+	for _, tt := range tests {
+		if got := distinctPostTags(tt.in); !reflect.DeepEqual(got, tt.want) { t.Errorf("distinctPostTags(%q) = %q, want %q", tt.in, got, tt.want) }
+	}
+}
+
+func TestFeedPostTags(t *testing.T) {
+	var categories []string
+	for i := 0; i < 300; i++ { categories = append(categories, fmt.Sprintf("Category %d", i%150), "") }
+	tags := feedPostTags(categories)
+	if len(tags) != maxPostTags { t.Fatalf("got %d tags, want %d", len(tags), maxPostTags) }
+	for i, tag := range tags {
+		if want := fmt.Sprintf("Category %d", i); tag != want { t.Errorf("tag %d = %q, want %q", i, tag, want) }
+	}
+	if got := feedPostTags([]string{"a", "A", "b"}); !reflect.DeepEqual(got, []string{"a", "b"}) { t.Errorf("feedPostTags = %q", got) }
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+// PostSort is the ordering of a post listing. A leading "-" means descending.
+type PostSort string
+
+const (
+	SortCreatedDesc   PostSort = "-created"
+	SortCreatedAsc    PostSort = "created"
+	SortPublishedDesc PostSort = "-published"
+	SortPublishedAsc  PostSort = "published"
+	// SortRank orders full-text search results by relevance.
+	SortRank PostSort = "-rank"
+)
+
+func (s PostSort) valid() bool {
+	switch s {
+	case SortCreatedDesc, SortCreatedAsc, SortPublishedDesc, SortPublishedAsc, SortRank:
+		return true
+	}
+	return false
+}
+
+func (s PostSort) desc() bool { return strings.HasPrefix(string(s), "-") }
+
+// postCursor marks the last post of a page. The next page starts strictly
+// after it, so rows inserted in the meantime neither shift nor repeat items.
+// Rank is only set for relevance-sorted pages, Time for all others.
+type postCursor struct {
+	Sort PostSort  `json:"s"`
+	Time time.Time `json:"t"`
+	Rank float64   `json:"r,omitempty"`
+	ID   int64     `json:"i"`
+}
+
+func (c postCursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodePostCursor(s string) (*postCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil { return nil, errors.New("invalid cursor") }
+	c := &postCursor{}
+	if err := json.Unmarshal(b, c); err != nil || !c.Sort.valid() {
+		return nil, errors.New("invalid cursor")
+	}
+	return c, nil
+}
+
+// PostListParams holds the filters, ordering and page of a post listing.
+type PostListParams struct {
+	Limit    int
+	Cursor   *postCursor
+	Sort     PostSort
+	Source   string
+	FeedID   int64
+	// FeedGroup limits the listing to posts from feeds in that group.
+	FeedGroup string
+	Author   string
+	AuthorID int64
+	From     *time.Time
+	To       *time.Time
+	// Tags must all be present on a post; aliases are resolved.
+	Tags []string
+	// Statuses limits the listing to posts in any of these statuses.
+	Statuses []string
+	// Deleted lists the trash instead of live posts.
+	Deleted bool
+	// Query is a full-text search query in tsquery syntax (see buildTSQuery);
+	// Lang restricts matching to one text search configuration.
+	Query string
+	Lang  string
+	// Collapse keeps one post per cluster of near-duplicates: the oldest
+	// one matching the filters (?collapse=true).
+	Collapse bool
+	// ExcerptOnly drops the full content from the response (?view=excerpt).
+	ExcerptOnly bool
+}
+
+// keyExpr is the value the listing is ordered by; p.id breaks ties.
+func (p PostListParams) keyExpr() string {
+	switch strings.TrimPrefix(string(p.Sort), "-") {
+	case "published":
+		return "COALESCE(p.published_at, p.created_at)"
+	case "rank":
+		return searchRankExpr(p.Lang)
+	}
+	return "p.created_at"
+}
+
+// applyFilters adds the listing filters on the posts table aliased as t.
+func (p PostListParams) applyFilters(q *queryBuilder, t string) {
+	if p.Deleted {
+		q.where(t + ".deleted_at IS NOT NULL")
+	} else {
+		q.where(t + ".deleted_at IS NULL")
+	}
+	if p.Source != "" { q.where(t+".source = ?", p.Source) }
+	if p.FeedID != 0 { q.where(t+".feed_id = ?", p.FeedID) }
+	if p.FeedGroup != "" { q.where(t+".feed_id IN (SELECT id FROM feeds WHERE group_name = ?)", p.FeedGroup) }
+	if p.Author != "" { q.where("LOWER("+t+".author) = LOWER(?)", p.Author) }
+	if p.AuthorID != 0 { q.where(t+".author_id = ?", p.AuthorID) }
+	if p.From != nil { q.where("COALESCE("+t+".published_at, "+t+".created_at) >= ?", *p.From) }
+	if p.To != nil { q.where("COALESCE("+t+".published_at, "+t+".created_at) < ?", *p.To) }
+	if len(p.Statuses) > 0 { q.where(t+".status = ANY(?)", pq.Array(p.Statuses)) }
+	for _, tag := range p.Tags {
+		slug := normalizeTagSlug(tag)
+		q.where("EXISTS (SELECT 1 FROM post_tags pt WHERE pt.post_id = "+t+".id AND pt.tag_id IN (SELECT id FROM tags WHERE slug = ? UNION ALL SELECT tag_id FROM tag_aliases WHERE slug = ?))", slug, slug)
+	}
+	if p.Query != "" { q.where(searchMatchExpr(p.Lang, t)) }
+}
+
+// parsePostListParams reads the query string of a post listing request.
+func parsePostListParams(r *http.Request) (PostListParams, error) {
+	v := r.URL.Query()
+	p := PostListParams{Limit: defaultPageSize, Sort: SortCreatedDesc}
+	if s := strings.TrimSpace(v.Get("q")); s != "" {
+		tsq, err := buildTSQuery(s)
+		if err != nil { return p, err }
+		p.Query = tsq
+		p.Sort = SortRank
+	}
+	p.Lang = v.Get("lang")
+	if _, ok := searchConfigs[p.Lang]; !ok && p.Lang != "" {
+		return p, fmt.Errorf("unsupported lang %q", p.Lang)
+	}
+	if s := v.Get("collapse"); s != "" {
+		b, err := strconv.ParseBool(s)
+		if err != nil { return p, errors.New("collapse must be true or false") }
+		p.Collapse = b
+	}
+	switch v.Get("view") {
+	case "", "full":
+	case "excerpt": p.ExcerptOnly = true
+	default: return p, errors.New("view must be full or excerpt")
+	}
+	if s := v.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 { return p, errors.New("limit must be a positive integer") }
+		p.Limit = min(n, maxPageSize)
+	}
+	if s := v.Get("sort"); s != "" {
+		p.Sort = PostSort(s)
+		if !p.Sort.valid() { return p, fmt.Errorf("unsupported sort %q", s) }
+		if p.Sort == SortRank && p.Query == "" { return p, errors.New("sort by rank requires a search query") }
+	}
+	if s := v.Get("cursor"); s != "" {
+		c, err := decodePostCursor(s)
+		if err != nil { return p, err }
+		if c.Sort != p.Sort { return p, errors.New("cursor does not match sort") }
+		p.Cursor = c
+	}
+	p.Source = v.Get("source")
+	p.Author = v.Get("author")
+	p.FeedGroup = strings.TrimSpace(v.Get("group"))
+	p.Tags = v["tag"]
+	for _, st := range v["status"] {
+		if !validPostStatus(st) { return p, fmt.Errorf("invalid status %q", st) }
+		p.Statuses = append(p.Statuses, st)
+	}
+	var err error
+	if p.FeedID, err = parseOptionalID(v.Get("feed_id")); err != nil { return p, errors.New("invalid feed_id") }
+	if p.AuthorID, err = parseOptionalID(v.Get("author_id")); err != nil { return p, errors.New("invalid author_id") }
+	if p.From, err = parseDateParam(v.Get("from")); err != nil { return p, errors.New("invalid from date") }
+	if p.To, err = parseDateParam(v.Get("to")); err != nil { return p, errors.New("invalid to date") }
+	return p, nil
+}
+
+func parseOptionalID(s string) (int64, error) {
+	if s == "" { return 0, nil }
+	id, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || id < 1 { return 0, errors.New("invalid id") }
+	return id, nil
+}
+
+// parseDateParam accepts RFC 3339 timestamps and plain YYYY-MM-DD dates (UTC midnight).
+func parseDateParam(s string) (*time.Time, error) {
+	if s == "" { return nil, nil }
+	if t, err := time.Parse(time.RFC3339, s); err == nil { return &t, nil }
+	t, err := time.Parse(time.DateOnly, s)
+	if err != nil { return nil, err }
+	return &t, nil
+}
+
+// setNextLink advertises the next page in a Link header, keeping the other
+// query parameters of the current request.
+func setNextLink(w http.ResponseWriter, r *http.Request, cursor string) {
+	if cursor == "" { return }
+	u := url.URL{Path: r.URL.Path}
+	q := r.URL.Query()
+	q.Set("cursor", cursor)
+	u.RawQuery = q.Encode()
+	w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, u.String()))
+}
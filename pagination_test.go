@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+func TestPostCursorRoundTrip(t *testing.T) {
+	at := time.Date(2024, 5, 17, 9, 30, 0, 123000000, time.UTC)
+	tests := []postCursor{
+		{Sort: SortCreatedDesc, Time: at, ID: 42},
+		{Sort: SortCreatedAsc, Time: at, ID: 1},
+		{Sort: SortPublishedDesc, Time: at.Add(time.Hour), ID: 7},
+		{Sort: SortPublishedAsc, Time: time.Time{}, ID: 9000000000},
+	}
+	for _, c := range tests {
+		got, err := decodePostCursor(c.encode())
+		if err != nil { t.Errorf("decode(%+v): %v", c, err); continue }
+		if got.Sort != c.Sort || !got.Time.Equal(c.Time) || got.ID != c.ID || got.Rank != c.Rank {
+			t.Errorf("round trip of %+v gave %+v", c, *got)
+		}
+	}
+}
+
+func TestDecodePostCursorInvalid(t *testing.T) {
+	tests := map[string]string{
+		"empty":        "",
+		"not base64":   "***",
+		"not json":     base64.RawURLEncoding.EncodeToString([]byte("nope")),
+		"unknown sort": base64.RawURLEncoding.EncodeToString([]byte(`{"s":"title","t":"2024-01-01T00:00:00Z","i":1}`)),
+		"no sort":      base64.RawURLEncoding.EncodeToString([]byte(`{"t":"2024-01-01T00:00:00Z","i":1}`)),
+		"padded":       base64.URLEncoding.EncodeToString([]byte(`{"s":"-created","t":"2024-01-01T00:00:00Z","i":1}`)),
+	}
+	for name, s := range tests {
+		if c, err := decodePostCursor(s); err == nil {
+			t.Errorf("%s: decoded %q as %+v", name, s, *c)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// fieldErrors maps a JSON field name to what is wrong with its value.
+type fieldErrors map[string]string
+
+// postReadOnlyFields are part of the Post representation but cannot be patched.
+var postReadOnlyFields = map[string]bool{
+	"id": true, "content_html": true, "feed_id": true, "author": true, "author_id": true, "created_at": true,
+	"updated_at": true, "deleted_at": true, "version": true, "rank": true, "snippet": true,
+	// Derived from the content.
+	"excerpt": true, "word_count": true, "reading_time": true,
+	// Set by duplicate clustering.
+	"cluster_id": true, "also_reported_by": true,
+	// Set by story grouping.
+	"keywords": true, "story_id": true,
+}
+
+// applyPostMergePatch applies a JSON Merge Patch (RFC 7396) document to p
+// and returns the resulting update. Members set to null are cleared where
+// the field is optional; arrays (tags) are replaced as a whole.
+func applyPostMergePatch(p *Post, body []byte) (PostUpdate, fieldErrors) {
+	errs := fieldErrors{}
+	u := PostUpdate{
+		Title:          p.Title,
+		Content:        p.Content,
+		ContentFormat:  p.ContentFormat,
+		Status:         p.Status,
+		PublishAt:      p.PublishAt,
+		SetSource:      true,
+		Source:         p.Source,
+		SetPublishedAt: true,
+		PublishedAt:    p.PublishedAt,
+	}
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(body, &doc); err != nil || doc == nil {
+		errs["body"] = "must be a JSON object"
+		return u, errs
+	}
+	for key, raw := range doc {
+		null := bytes.Equal(bytes.TrimSpace(raw), []byte("null"))
+		switch key {
+		case "title", "content":
+			v, msg := patchString(raw, null)
+			if msg != "" { errs[key] = msg; continue }
+			if key == "title" { u.Title = v } else { u.Content = v }
+		case "slug":
+			u.SetSlug, u.Slug = true, ""
+			if null { continue }
+			if json.Unmarshal(raw, &u.Slug) != nil || !validSlug(u.Slug) {
+				errs[key] = "must contain only lowercase latin letters, digits and hyphens (use null to regenerate it)"
+			}
+		case "source":
+			if null { u.Source = nil; continue }
+			v, msg := patchString(raw, false)
+			if msg != "" { errs[key] = msg + " (use null to clear it)"; continue }
+			u.Source = &v
+		case "published_at", "publish_at":
+			var t *time.Time
+			if !null {
+				t = new(time.Time)
+				if json.Unmarshal(raw, t) != nil { errs[key] = "must be an RFC 3339 timestamp"; continue }
+			}
+			if key == "published_at" { u.PublishedAt = t } else { u.PublishAt = t }
+		case "tags":
+			u.Tags = []string{}
+			if null { continue }
+			if json.Unmarshal(raw, &u.Tags) != nil { errs[key] = "must be an array of strings"; continue }
+			if len(distinctPostTags(u.Tags)) > maxPostTags { errs[key] = "must not have more than 20 tags"; continue }
+			for _, t := range u.Tags {
+				if normalizeTagSlug(t) == "" { errs[key] = "must not contain blank tags"; break }
+			}
+		case "content_format":
+			var v string
+			if null || json.Unmarshal(raw, &v) != nil || !validContentFormat(v) {
+				errs[key] = "must be one of plain, markdown, html"
+				continue
+			}
+			u.ContentFormat = v
+		case "status":
+			var v string
+			if null || json.Unmarshal(raw, &v) != nil || !validPostStatus(v) {
+				errs[key] = "must be one of draft, scheduled, published, unpublished"
+				continue
+			}
+			u.Status = v
+		default:
+			if postReadOnlyFields[key] {
+				errs[key] = "is read-only"
+			} else {
+				errs[key] = "unknown field"
+			}
+		}
+	}
+	if u.Status == PostStatusScheduled && u.PublishAt == nil && errs["publish_at"] == "" {
+		errs["publish_at"] = "is required for scheduled posts"
+	}
+	return u, errs
+}
+
+// patchString decodes a required, non-blank string member.
+func patchString(raw json.RawMessage, null bool) (string, string) {
+	if null { return "", "must not be null" }
+	var v string
+	if json.Unmarshal(raw, &v) != nil { return "", "must be a string" }
+	if strings.TrimSpace(v) == "" { return "", "must not be empty" }
+	return v, ""
+}
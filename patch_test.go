@@ -0,0 +1,112 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// postPatchableFields are the Post members applyPostMergePatch accepts.
+var postPatchableFields = []string{"title", "slug", "content", "content_format", "source", "status", "publish_at", "published_at", "tags"}
+
+// TestPostFieldsCovered makes sure every member of the Post representation
+// is either patchable or listed as read-only, so that a PATCH of a new
+// field never fails with "unknown field".
+func TestPostFieldsCovered(t *testing.T) {
+	patchable := map[string]bool{}
+	for _, f := range postPatchableFields { patchable[f] = true }
+	typ := reflect.TypeOf(Post{})
+	for i := 0; i < typ.NumField(); i++ {
+		name, _, _ := strings.Cut(typ.Field(i).Tag.Get("json"), ",")
+		if name == "" || name == "-" { continue }
+		if patchable[name] == postReadOnlyFields[name] {
+			t.Errorf("field %q must be either patchable or read-only", name)
+		}
+	}
+}
+
+func TestApplyPostMergePatch(t *testing.T) {
+	publishAt := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	source := "https://example.com/a"
+	base := func() *Post {
+		return &Post{Title: "Заголовок", Slug: "zagolovok", Content: "Текст", ContentFormat: ContentFormatPlain,
+			Status: PostStatusDraft, Source: &source, Tags: []string{"old"}}
+	}
+	tests := []struct {
+		name  string
+		body  string
+		check func(t *testing.T, u PostUpdate)
+	}{
+		{"empty patch keeps everything", `{}`, func(t *testing.T, u PostUpdate) {
+			if u.Title != "Заголовок" || u.Content != "Текст" || u.ContentFormat != ContentFormatPlain || u.Status != PostStatusDraft {
+				t.Errorf("update changed fields: %+v", u)
+			}
+			if u.Source == nil || *u.Source != source || !u.SetSource || !u.SetPublishedAt { t.Errorf("source not kept: %+v", u) }
+			if u.Tags != nil || u.SetSlug { t.Errorf("tags or slug touched: %+v", u) }
+		}},
+		{"title and content", `{"title": "Новый", "content": "Другой"}`, func(t *testing.T, u PostUpdate) {
+			if u.Title != "Новый" || u.Content != "Другой" { t.Errorf("got %q, %q", u.Title, u.Content) }
+		}},
+		{"null source clears it", `{"source": null}`, func(t *testing.T, u PostUpdate) {
+			if u.Source != nil { t.Errorf("source = %q", *u.Source) }
+		}},
+		{"null slug regenerates it", `{"slug": null}`, func(t *testing.T, u PostUpdate) {
+			if !u.SetSlug || u.Slug != "" { t.Errorf("slug = %v %q", u.SetSlug, u.Slug) }
+		}},
+		{"slug", `{"slug": "novyi-slug"}`, func(t *testing.T, u PostUpdate) {
+			if !u.SetSlug || u.Slug != "novyi-slug" { t.Errorf("slug = %v %q", u.SetSlug, u.Slug) }
+		}},
+		{"tags replaced", `{"tags": ["a", "b"]}`, func(t *testing.T, u PostUpdate) {
+			if !reflect.DeepEqual(u.Tags, []string{"a", "b"}) { t.Errorf("tags = %v", u.Tags) }
+		}},
+		{"null tags clear them", `{"tags": null}`, func(t *testing.T, u PostUpdate) {
+			if u.Tags == nil || len(u.Tags) != 0 { t.Errorf("tags = %#v", u.Tags) }
+		}},
+		{"scheduling", `{"status": "scheduled", "publish_at": "2030-01-02T03:04:05Z"}`, func(t *testing.T, u PostUpdate) {
+			if u.Status != PostStatusScheduled || u.PublishAt == nil || !u.PublishAt.Equal(publishAt) { t.Errorf("got %q %v", u.Status, u.PublishAt) }
+		}},
+		{"format", `{"content_format": "markdown"}`, func(t *testing.T, u PostUpdate) {
+			if u.ContentFormat != ContentFormatMarkdown { t.Errorf("format = %q", u.ContentFormat) }
+		}},
+	}
+	for _, tt := range tests {
+		u, errs := applyPostMergePatch(base(), []byte(tt.body))
+		if len(errs) != 0 { t.Errorf("%s: unexpected errors %v", tt.name, errs); continue }
+		t.Run(tt.name, func(t *testing.T) { tt.check(t, u) })
+	}
+}
+
+func TestApplyPostMergePatchErrors(t *testing.T) {
+	tests := []struct {
+		body  string
+		field string
+		want  string
+	}{
+		{`[]`, "body", "must be a JSON object"},
+		{`null`, "body", "must be a JSON object"},
+		{`{"title": null}`, "title", "must not be null"},
+		{`{"title": 5}`, "title", "must be a string"},
+		{`{"content": "  "}`, "content", "must not be empty"},
+		{`{"source": ""}`, "source", "must not be empty (use null to clear it)"},
+		{`{"slug": "Не слаг"}`, "slug", "must contain only lowercase latin letters, digits and hyphens (use null to regenerate it)"},
+		{`{"published_at": "вчера"}`, "published_at", "must be an RFC 3339 timestamp"},
+		{`{"tags": "a"}`, "tags", "must be an array of strings"},
+		{`{"tags": ["a", " "]}`, "tags", "must not contain blank tags"},
+		{`{"content_format": "rtf"}`, "content_format", "must be one of plain, markdown, html"},
+		{`{"status": null}`, "status", "must be one of draft, scheduled, published, unpublished"},
+		{`{"status": "scheduled"}`, "publish_at", "is required for scheduled posts"},
+		{`{"colour": "red"}`, "colour", "unknown field"},
+	}
+	for _, tt := range tests {
+		_, errs := applyPostMergePatch(&Post{Title: "t", Content: "c", Status: PostStatusDraft}, []byte(tt.body))
+		if errs[tt.field] != tt.want { t.Errorf("%s: %s error = %q, want %q (all: %v)", tt.body, tt.field, errs[tt.field], tt.want, errs) }
+	}
+}
+
+func TestApplyPostMergePatchReadOnly(t *testing.T) {
+	for field := range postReadOnlyFields {
+		_, errs := applyPostMergePatch(&Post{Title: "t", Content: "c", Status: PostStatusDraft}, []byte(`{"`+field+`": 1}`))
+		if errs[field] != "is read-only" { t.Errorf("%s: error = %q, want \"is read-only\"", field, errs[field]) }
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"html"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+	goldmarkhtml "github.com/yuin/goldmark/renderer/html"
+)
+
+// Content formats of a post body.
+const (
+	ContentFormatPlain    = "plain"
+	ContentFormatMarkdown = "markdown"
+	ContentFormatHTML     = "html"
+)
+
+func validContentFormat(f string) bool {
+	return f == ContentFormatPlain || f == ContentFormatMarkdown || f == ContentFormatHTML
+}
+
+// markdown renders CommonMark with GFM tables. Raw HTML is let through here
+// and cleaned up by htmlPolicy like any other HTML.
+var markdown = goldmark.New(
+	goldmark.WithExtensions(extension.Table),
+	goldmark.WithRendererOptions(goldmarkhtml.WithUnsafe()),
+)
+
+var htmlPolicy = func() *bluemonday.Policy {
+	p := bluemonday.UGCPolicy()
+	// Keep the language hint of fenced code blocks for client-side highlighting.
+	p.AllowAttrs("class").Matching(regexp.MustCompile(`^language-[\w+-]+$`)).OnElements("code")
+	return p
+}()
+
+// renderContent turns a post body into sanitized HTML.
+func renderContent(format, content string) (string, error) {
+	switch format {
+	case ContentFormatMarkdown:
+		var buf bytes.Buffer
+		if err := markdown.Convert([]byte(content), &buf); err != nil { return "", err }
+		return htmlPolicy.Sanitize(buf.String()), nil
+	case ContentFormatHTML:
+		return htmlPolicy.Sanitize(content), nil
+	case ContentFormatPlain:
+		return plainToHTML(content), nil
+	}
+	return "", errors.New("invalid content_format")
+}
+
+// plainToHTML escapes text and turns blank-line separated blocks into
+// paragraphs, keeping single line breaks.
+func plainToHTML(s string) string {
+	var b strings.Builder
+	for _, para := range strings.Split(strings.ReplaceAll(s, "\r\n", "\n"), "\n\n") {
+		para = strings.TrimSpace(para)
+		if para == "" { continue }
+		b.WriteString("<p>")
+		b.WriteString(strings.ReplaceAll(html.EscapeString(para), "\n", "<br>\n"))
+		b.WriteString("</p>\n")
+	}
+	return b.String()
+}
+
+// htmlToText extracts the visible text of rendered HTML with collapsed
+// whitespace. Tags count as word breaks.
+func htmlToText(s string) string {
+	var b strings.Builder
+	in := false
+	for _, r := range s {
+		switch {
+		case r == '<': in = true; b.WriteByte(' ')
+		case r == '>' && in: in = false
+		case !in: b.WriteRune(r)
+		}
+	}
+	return strings.Join(strings.Fields(html.UnescapeString(b.String())), " ")
+}
+
+const (
+	maxExcerptRunes = 280
+	wordsPerMinute  = 200
+)
+
+// excerpt shortens text to at most maxExcerptRunes runes (plus an
+// ellipsis), preferring to end after a full sentence and otherwise between
+// words.
+func excerpt(text string) string {
+	if utf8.RuneCountInString(text) <= maxExcerptRunes { return text }
+	runes := []rune(text)
+	cut := string(runes[:maxExcerptRunes])
+	// A sentence end in the second half of the window makes a natural stop.
+	for i := len(cut) - 1; i >= len(cut)/2; i-- {
+		if cut[i] == ' ' && (strings.ContainsAny(cut[i-1:i], ".!?") || strings.HasSuffix(cut[:i], "…")) {
+			return cut[:i]
+		}
+	}
+	if runes[maxExcerptRunes] != ' ' {
+		if i := strings.LastIndexByte(cut, ' '); i > 0 { cut = cut[:i] }
+	}
+	return strings.TrimRightFunc(cut, func(r rune) bool { return unicode.IsSpace(r) || unicode.IsPunct(r) }) + "…"
+}
+
+// countWords counts whitespace-separated tokens containing a letter or digit.
+func countWords(text string) int {
+	n := 0
+	for _, w := range strings.Fields(text) {
+		if strings.IndexFunc(w, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }) >= 0 { n++ }
+	}
+	return n
+}
+
+// derivedPostFields are computed from the authored fields of a post on
+// every write and stored alongside them.
+type derivedPostFields struct {
+	ContentHTML string
+	// Text is the plain text of the rendered content, for search snippets.
+	Text        string
+	Excerpt     string
+	WordCount   int
+	// ReadingTime is in whole minutes, at least 1 for non-empty posts.
+	ReadingTime int
+	// Fingerprint is the SimHash of title and text; 0 for short posts.
+	Fingerprint int64
+}
+
+func derivePostFields(title, format, content string) (derivedPostFields, error) {
+	var d derivedPostFields
+	var err error
+	d.ContentHTML, err = renderContent(format, content)
+	if err != nil { return d, err }
+	d.Text = htmlToText(d.ContentHTML)
+	d.Excerpt = excerpt(d.Text)
+	d.WordCount = countWords(d.Text)
+	d.ReadingTime = (d.WordCount + wordsPerMinute - 1) / wordsPerMinute
+	d.Fingerprint = simhash(title + " " + d.Text)
+	return d, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestHTMLToText(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"", ""},
+		{"<p>Привет, <b>мир</b>!</p>", "Привет, мир !"},
+		{"<p>one</p><p>two</p>", "one two"},
+		{"a&amp;b &lt;tag&gt; &quot;q&quot;", `a&b <tag> "q"`},
+		{"line<br>\nbreak", "line break"},
+		{"  spaced \n\t out  ", "spaced out"},
+	}
+	for _, tt := range tests {
+		if got := htmlToText(tt.in); got != tt.want { t.Errorf("htmlToText(%q) = %q, want %q", tt.in, got, tt.want) }
+	}
+}
+
+func TestExcerpt(t *testing.T) {
+	atLimit := strings.Repeat("я", maxExcerptRunes)
+	sentence := strings.Repeat("а", 150) + ". " + strings.Repeat("б", 200)
+	tests := []struct {
+		name, in, want string
+	}{
+		{"short text is kept", "Короткий текст.", "Короткий текст."},
+		{"text at the limit is kept", atLimit, atLimit},
+		// "слово " is 6 runes, so the limit falls inside the 47th word.
+		{"cut between words", strings.Repeat("слово ", 60), strings.TrimSpace(strings.Repeat("слово ", 46)) + "…"},
+		{"cut after a sentence", sentence, strings.Repeat("а", 150) + "."},
+		// "слово, " is 7 runes, so the limit falls right after the 40th comma.
+		{"trailing punctuation dropped", strings.Repeat("слово, ", 50), strings.TrimSuffix(strings.TrimSpace(strings.Repeat("слово, ", 40)), ",") + "…"},
+	}
+	for _, tt := range tests {
+		got := excerpt(tt.in)
+		if got != tt.want { t.Errorf("%s: excerpt = %q, want %q", tt.name, got, tt.want) }
+		if n := utf8.RuneCountInString(got); n > maxExcerptRunes+1 { t.Errorf("%s: excerpt has %d runes", tt.name, n) }
+	}
+}
+
+func TestExcerptLongWord(t *testing.T) {
+	in := strings.Repeat("я", maxExcerptRunes*2)
+	if got, want := excerpt(in), strings.Repeat("я", maxExcerptRunes)+"…"; got != want {
+		t.Errorf("excerpt of one long word = %q, want %q", got, want)
+	}
+}
+
+func TestCountWords(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int
+	}{
+		{"", 0},
+		{"   ", 0},
+		{"один", 1},
+		{"Курс тенге вырос на 2%", 5},
+		{"слово — тире - и ... точки", 4},
+		{"e-mail и COVID-19", 3},
+		{"«цитата»\nна\tстроках", 3},
+	}
+	for _, tt := range tests {
+		if got := countWords(tt.in); got != tt.want { t.Errorf("countWords(%q) = %d, want %d", tt.in, got, tt.want) }
+	}
+}
+
+func TestDerivePostFieldsReadingTime(t *testing.T) {
+	tests := []struct {
+		words, minutes int
+	}{
+		{0, 0},
+		{1, 1},
+		{wordsPerMinute, 1},
+		{wordsPerMinute + 1, 2},
+		{wordsPerMinute * 5, 5},
+	}
+	for _, tt := range tests {
+		d, err := derivePostFields("t", ContentFormatPlain, strings.Repeat("слово ", tt.words))
+		if err != nil { t.Fatal(err) }
+		if d.WordCount != tt.words || d.ReadingTime != tt.minutes {
+			t.Errorf("%d words: got %d words, %d min, want %d min", tt.words, d.WordCount, d.ReadingTime, tt.minutes)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Permissions checked by RequirePermission. posts:write_own lets a user
+// create posts and change the ones they created.
+const (
+	PermPostsRead     = "posts:read"
+	PermPostsWrite    = "posts:write"
+	PermPostsWriteOwn = "posts:write_own"
+	PermTagsManage    = "tags:manage"
+	PermFeedsManage   = "feeds:manage"
+	PermUsersManage   = "users:manage"
+	PermRolesManage   = "roles:manage"
+)
+
+var allPermissions = []string{
+	PermPostsRead, PermPostsWrite, PermPostsWriteOwn, PermTagsManage, PermFeedsManage, PermUsersManage, PermRolesManage,
+}
+
+const (
+	RoleAdmin  = "admin"
+	RoleEditor = "editor"
+	RoleAuthor = "author"
+	RoleViewer = "viewer"
+	RoleMember = "member"
+)
+
+// builtinRoles are seeded by migrate and cannot be changed or deleted, so
+// their meaning is the same on every installation; custom roles cover the rest.
+var builtinRoles = []Role{
+	{Name: RoleAdmin, Description: "Full access", Permissions: allPermissions},
+	{Name: RoleEditor, Description: "Manages all posts, tags and feeds", Permissions: []string{PermPostsRead, PermPostsWrite, PermTagsManage, PermFeedsManage}},
+	{Name: RoleAuthor, Description: "Writes and edits their own posts", Permissions: []string{PermPostsRead, PermPostsWriteOwn}},
+	{Name: RoleViewer, Description: "Reads unpublished posts", Permissions: []string{PermPostsRead}},
+	{Name: RoleMember, Description: "Registered reader without admin access", Permissions: []string{}},
+}
+
+// seedRolesStmts inserts the builtin roles and their permissions.
+func seedRolesStmts() []string {
+	var stmts []string
+	for _, r := range builtinRoles {
+		stmts = append(stmts, fmt.Sprintf(`INSERT INTO roles (name, description, builtin) VALUES (%s, %s, TRUE) ON CONFLICT (name) DO NOTHING`,
+			pq.QuoteLiteral(r.Name), pq.QuoteLiteral(r.Description)))
+		for _, p := range r.Permissions {
+			stmts = append(stmts, fmt.Sprintf(`INSERT INTO role_permissions (role, permission) VALUES (%s, %s) ON CONFLICT DO NOTHING`,
+				pq.QuoteLiteral(r.Name), pq.QuoteLiteral(p)))
+		}
+	}
+	return stmts
+}
+
+var (
+	ErrRoleBuiltin = errors.New("builtin roles cannot be changed")
+	ErrRoleInUse   = errors.New("role is assigned to users")
+	ErrRoleExists  = errors.New("role already exists")
+)
+
+type Role struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Permissions []string  `json:"permissions"`
+	Builtin     bool      `json:"builtin"`
+	UserCount   int       `json:"user_count"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+var roleNameRe = regexp.MustCompile(`^[a-z][a-z0-9_-]{1,31}$`)
+
+// validatePermissions rejects unknown permissions and returns the rest
+// sorted and without duplicates.
+func validatePermissions(perms []string) ([]string, error) {
+	seen := map[string]bool{}
+	out := []string{}
+	for _, p := range perms {
+		p = strings.TrimSpace(p)
+		known := false
+		for _, k := range allPermissions { known = known || k == p }
+		if !known { return nil, fmt.Errorf("unknown permission %q", p) }
+		if !seen[p] { seen[p] = true; out = append(out, p) }
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// RoleService stores roles. Permission lookups are served from memory and
+// reloaded after any role change made through the service.
+type RoleService struct {
+	db    DB
+	mu    sync.RWMutex
+	perms map[string]map[string]bool
+}
+
+func NewRoleService(db DB) *RoleService { return &RoleService{db: db} }
+
+// Permissions returns the permission set of a role; unknown roles have none.
+func (s *RoleService) Permissions(ctx context.Context, role string) (map[string]bool, error) {
+	s.mu.RLock()
+	perms := s.perms
+	s.mu.RUnlock()
+	if perms == nil {
+		rows, err := s.db.QueryContext(ctx, "SELECT role, permission FROM role_permissions")
+		if err != nil { return nil, err }
+		defer rows.Close()
+		perms = map[string]map[string]bool{}
+		for rows.Next() {
+			var r, p string
+			if err := rows.Scan(&r, &p); err != nil { return nil, err }
+			if perms[r] == nil { perms[r] = map[string]bool{} }
+			perms[r][p] = true
+		}
+		if err := rows.Err(); err != nil { return nil, err }
+		s.mu.Lock()
+		s.perms = perms
+		s.mu.Unlock()
+	}
+	return perms[role], nil
+}
+
+func (s *RoleService) invalidate() {
+	s.mu.Lock()
+	s.perms = nil
+	s.mu.Unlock()
+}
+
+const roleColumns = `r.name, r.description, r.builtin, r.created_at,
+	ARRAY(SELECT permission FROM role_permissions rp WHERE rp.role = r.name ORDER BY permission),
+	(SELECT COUNT(*) FROM users u WHERE u.role = r.name AND u.deleted_at IS NULL)`
+
+func scanRole(row rowScanner) (*Role, error) {
+	r := &Role{}
+	if err := row.Scan(&r.Name, &r.Description, &r.Builtin, &r.CreatedAt, pq.Array(&r.Permissions), &r.UserCount); err != nil {
+		if errors.Is(err, sql.ErrNoRows) { return nil, ErrNotFound }
+		return nil, err
+	}
+	if r.Permissions == nil { r.Permissions = []string{} }
+	return r, nil
+}
+
+func (s *RoleService) List(ctx context.Context) ([]*Role, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT "+roleColumns+" FROM roles r ORDER BY r.builtin DESC, r.name")
+	if err != nil { return nil, err }
+	defer rows.Close()
+	roles := []*Role{}
+	for rows.Next() {
+		r, err := scanRole(rows)
+		if err != nil { return nil, err }
+		roles = append(roles, r)
+	}
+	return roles, rows.Err()
+}
+
+func (s *RoleService) Get(ctx context.Context, name string) (*Role, error) {
+	return scanRole(s.db.QueryRowContext(ctx, "SELECT "+roleColumns+" FROM roles r WHERE r.name = $1", name))
+}
+
+func (s *RoleService) Create(ctx context.Context, name, description string, perms []string) (*Role, error) {
+	if !roleNameRe.MatchString(name) { return nil, errors.New("role name must be 2-32 lowercase letters, digits, '-' or '_'") }
+	perms, err := validatePermissions(perms)
+	if err != nil { return nil, err }
+	err = withTx(ctx, s.db, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, "INSERT INTO roles (name, description) VALUES ($1, $2) ON CONFLICT (name) DO NOTHING", name, description)
+		if err != nil { return err }
+		if n, _ := res.RowsAffected(); n == 0 { return ErrRoleExists }
+		return setRolePermissions(ctx, tx, name, perms)
+	})
+	if err != nil { return nil, err }
+	s.invalidate()
+	return s.Get(ctx, name)
+}
+
+// Update replaces the description and permissions of a custom role.
+func (s *RoleService) Update(ctx context.Context, name, description string, perms []string) (*Role, error) {
+	perms, err := validatePermissions(perms)
+	if err != nil { return nil, err }
+	err = withTx(ctx, s.db, func(tx *sql.Tx) error {
+		var builtin bool
+		err := tx.QueryRowContext(ctx, "SELECT builtin FROM roles WHERE name = $1 FOR UPDATE", name).Scan(&builtin)
+		if errors.Is(err, sql.ErrNoRows) { return ErrNotFound }
+		if err != nil { return err }
+		if builtin { return ErrRoleBuiltin }
+		if _, err := tx.ExecContext(ctx, "UPDATE roles SET description = $1 WHERE name = $2", description, name); err != nil { return err }
+		return setRolePermissions(ctx, tx, name, perms)
+	})
+	if err != nil { return nil, err }
+	s.invalidate()
+	return s.Get(ctx, name)
+}
+
+func setRolePermissions(ctx context.Context, q querier, role string, perms []string) error {
+	if _, err := q.ExecContext(ctx, "DELETE FROM role_permissions WHERE role = $1", role); err != nil { return err }
+	_, err := q.ExecContext(ctx, "INSERT INTO role_permissions (role, permission) SELECT $1, unnest($2::text[])", role, pq.Array(perms))
+	return err
+}
+
+// Delete removes a custom role no user has, deleted users included.
+func (s *RoleService) Delete(ctx context.Context, name string) error {
+	err := withTx(ctx, s.db, func(tx *sql.Tx) error {
+		var builtin bool
+		err := tx.QueryRowContext(ctx, "SELECT builtin FROM roles WHERE name = $1 FOR UPDATE", name).Scan(&builtin)
+		if errors.Is(err, sql.ErrNoRows) { return ErrNotFound }
+		if err != nil { return err }
+		if builtin { return ErrRoleBuiltin }
+		var used bool
+		if err := tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM users WHERE role = $1)", name).Scan(&used); err != nil { return err }
+		if used { return ErrRoleInUse }
+		_, err = tx.ExecContext(ctx, "DELETE FROM roles WHERE name = $1", name)
+		return err
+	})
+	if err != nil { return err }
+	s.invalidate()
+	return nil
+}
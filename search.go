@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+)
+
+// searchConfigs maps the lang query parameter to PostgreSQL text search
+// configurations; every post is indexed under each of them.
+var searchConfigs = map[string]string{
+	"ru": "russian",
+	"en": "english",
+}
+
+const maxSearchQueryLen = 256
+
+// buildTSQuery converts a user search query into to_tsquery syntax.
+// Supported forms: plain words (all must match), "quoted phrases",
+// prefix* matches, -negation and OR between terms. Everything except
+// letters and digits is dropped, so the result is always a valid tsquery.
+func buildTSQuery(input string) (string, error) {
+	if len([]rune(input)) > maxSearchQueryLen {
+		return "", errors.New("search query is too long")
+	}
+	var b strings.Builder
+	op := ""
+	rest := input
+	for {
+		rest = strings.TrimLeftFunc(rest, unicode.IsSpace)
+		if rest == "" { break }
+		negate := false
+		if rest[0] == '-' {
+			negate = true
+			rest = rest[1:]
+		}
+		var raw string
+		phrase := false
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 { end = len(rest) - 1 }
+			raw, rest = rest[1:end+1], rest[min(end+2, len(rest)):]
+			phrase = true
+		} else {
+			end := strings.IndexFunc(rest, unicode.IsSpace)
+			if end < 0 { end = len(rest) }
+			raw, rest = rest[:end], rest[end:]
+		}
+		if !phrase && (raw == "OR" || raw == "|") {
+			if b.Len() > 0 { op = " | " }
+			continue
+		}
+		term := tsTerm(raw, !phrase && strings.HasSuffix(raw, "*"))
+		if term == "" { continue }
+		if negate { term = "!" + term }
+		if b.Len() > 0 {
+			if op == "" { op = " & " }
+			b.WriteString(op)
+		}
+		b.WriteString(term)
+		op = ""
+	}
+	if b.Len() == 0 {
+		return "", errors.New("search query is empty")
+	}
+	return b.String(), nil
+}
+
+// tsTerm turns one word or phrase into a tsquery operand. Words inside a
+// phrase (or a hyphenated word) must be adjacent.
+func tsTerm(raw string, prefix bool) string {
+	words := strings.FieldsFunc(raw, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) })
+	if len(words) == 0 { return "" }
+	if prefix { words[len(words)-1] += ":*" }
+	if len(words) == 1 { return words[0] }
+	return "(" + strings.Join(words, " <-> ") + ")"
+}
+
+// searchFrom joins the parsed query once per configuration as ts.ru / ts.en.
+func searchFrom(q *queryBuilder, tsquery string) string {
+	ph := q.arg(tsquery)
+	return ", (SELECT to_tsquery('russian', " + ph + ") AS ru, to_tsquery('english', " + ph + ") AS en) ts"
+}
+
+// searchLangs lists the configurations a lang parameter searches in.
+func searchLangs(lang string) []string {
+	if lang != "" { return []string{lang} }
+	return []string{"ru", "en"}
+}
+
+// searchMatchExpr matches posts aliased as t against the joined query.
+func searchMatchExpr(lang, t string) string {
+	var parts []string
+	for _, l := range searchLangs(lang) {
+		parts = append(parts, t+".search_"+l+" @@ ts."+l)
+	}
+	return "(" + strings.Join(parts, " OR ") + ")"
+}
+
+func searchRankExpr(lang string) string {
+	var parts []string
+	for _, l := range searchLangs(lang) {
+		parts = append(parts, "ts_rank(p.search_"+l+", ts."+l+")")
+	}
+	if len(parts) == 1 { return parts[0] }
+	return "GREATEST(" + strings.Join(parts, ", ") + ")"
+}
+
+// searchSnippetExpr highlights matches with <mark> in the HTML-escaped
+// plain text of the post, so Markdown and HTML markup never show up in
+// snippets, using the first configuration that matched the post. Posts not
+// backfilled yet fall back to their source.
+func searchSnippetExpr(lang string) string {
+	const text = `replace(replace(replace(COALESCE(p.content_text, p.content), '&', '&amp;'), '<', '&lt;'), '>', '&gt;')`
+	const opts = `'StartSel=<mark>, StopSel=</mark>, MinWords=15, MaxWords=35, MaxFragments=2, FragmentDelimiter=" … "'`
+	langs := searchLangs(lang)
+	expr := "ts_headline('" + searchConfigs[langs[len(langs)-1]] + "', " + text + ", ts." + langs[len(langs)-1] + ", " + opts + ")"
+	for i := len(langs) - 2; i >= 0; i-- {
+		l := langs[i]
+		expr = "CASE WHEN p.search_" + l + " @@ ts." + l + " THEN ts_headline('" + searchConfigs[l] + "', " + text + ", ts." + l + ", " + opts + ") ELSE " + expr + " END"
+	}
+	return expr
+}
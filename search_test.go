@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBuildTSQuery(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"погода", "погода"},
+		{"погода алматы", "погода & алматы"},
+		{"  погода   алматы  ", "погода & алматы"},
+		{`"курс тенге"`, "(курс <-> тенге)"},
+		{`"курс тенге" рост`, "(курс <-> тенге) & рост"},
+		{`"незакрытая фраза`, "(незакрытая <-> фраза)"},
+		{"эконом*", "эконом:*"},
+		{`"эконом*"`, "эконом"},
+		{"-спорт", "!спорт"},
+		{"новости -спорт", "новости & !спорт"},
+		{"нефть OR газ", "нефть | газ"},
+		{"нефть | газ", "нефть | газ"},
+		{"нефть or газ", "нефть & or & газ"},
+		{"OR нефть", "нефть"},
+		{"нефть OR", "нефть"},
+		{"нефть OR газ уголь", "нефть | газ & уголь"},
+		{"e-mail", "(e <-> mail)"},
+		{"it's", "(it <-> s)"},
+		{"a&b|c", "(a <-> b <-> c)"},
+		{"!:*() нефть", "нефть"},
+		{"Covid-19*", "(Covid <-> 19:*)"},
+	}
+	for _, tt := range tests {
+		got, err := buildTSQuery(tt.in)
+		if err != nil { t.Errorf("buildTSQuery(%q): %v", tt.in, err); continue }
+		if got != tt.want { t.Errorf("buildTSQuery(%q) = %q, want %q", tt.in, got, tt.want) }
+	}
+}
+
+func TestBuildTSQueryErrors(t *testing.T) {
+	for _, in := range []string{"", "   ", "OR", `""`, "- * !", strings.Repeat("а", maxSearchQueryLen+1)} {
+		if got, err := buildTSQuery(in); err == nil {
+			t.Errorf("buildTSQuery(%q) = %q, want an error", in, got)
+		}
+	}
+	if _, err := buildTSQuery(strings.Repeat("а", maxSearchQueryLen)); err != nil {
+		t.Errorf("query of maximum length: %v", err)
+	}
+}
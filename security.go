@@ -4,14 +4,19 @@ import (
 	"context"
 	"errors"
 	"net/http"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"golang.org/x/crypto/bcrypt"
 )
 
-type PasswordHasher struct{}
+type PasswordHasher struct {
+	dummyOnce sync.Once
+	dummy     string
+}
 
 func NewPasswordHasher() *PasswordHasher { return &PasswordHasher{} }
 
@@ -25,32 +30,109 @@ func (p *PasswordHasher) VerifyPassword(hash, plain string) bool {
 	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(plain)) == nil
 }
 
+// DummyHash is a hash no password matches. Checking a password against it
+// for unknown users takes as long as a real check, so response times do
+// not reveal which accounts exist.
+func (p *PasswordHasher) DummyHash() string {
+	p.dummyOnce.Do(func() {
+		h, err := bcrypt.GenerateFromPassword([]byte(randomToken(32)), bcrypt.DefaultCost)
+		if err != nil { panic(err) }
+		p.dummy = string(h)
+	})
+	return p.dummy
+}
+
+// JWTManager signs and verifies access tokens. With a key directory it
+// uses the asymmetric keys found there, identified by kid; otherwise it
+// falls back to HS256 with a shared secret.
 type JWTManager struct {
 	secret []byte
 	exp    time.Duration
+	dir    string
+	mu     sync.RWMutex
+	keys   map[string]*signingKey
 }
 
 func NewJWTManager(secret string, exp time.Duration) *JWTManager {
 	return &JWTManager{secret: []byte(secret), exp: exp}
 }
 
-func (j *JWTManager) GenerateToken(userID int64, isAdmin bool) (string, error) {
+// NewJWTManagerFromDir loads the signing keys of dir; see signingKey for
+// the file layout.
+func NewJWTManagerFromDir(dir string, exp time.Duration) (*JWTManager, error) {
+	j := &JWTManager{exp: exp, dir: dir, keys: map[string]*signingKey{}}
+	if err := j.Reload(); err != nil { return nil, err }
+	if _, err := j.signingKey(); err != nil { return nil, err }
+	return j, nil
+}
+
+// Reload rereads the key directory. Keys whose files are gone are retired
+// rather than dropped, so tokens they signed stay valid until expiry.
+func (j *JWTManager) Reload() error {
+	if j.dir == "" { return nil }
+	loaded, err := loadSigningKeys(j.dir)
+	if err != nil { return err }
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := time.Now()
+	for kid, k := range j.keys {
+		if _, ok := loaded[kid]; ok { continue }
+		if k.retiredAt.IsZero() { k.retiredAt = now }
+		if now.Sub(k.retiredAt) < j.exp { loaded[kid] = k }
+	}
+	j.keys = loaded
+	return nil
+}
+
+// signingKey picks the key to sign with: the greatest kid that is active.
+func (j *JWTManager) signingKey() (*signingKey, error) {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	var best *signingKey
+	now := time.Now()
+	for _, k := range j.keys {
+		if !k.retiredAt.IsZero() || k.activeFrom.After(now) { continue }
+		if best == nil || k.kid > best.kid { best = k }
+	}
+	if best == nil { return nil, errors.New("no active JWT signing key in " + j.dir) }
+	return best, nil
+}
+
+// JWKS returns the public keys tokens may be signed with, including keys
+// scheduled for later and retired keys whose tokens have not expired yet.
+func (j *JWTManager) JWKS() jwkSet {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	set := jwkSet{Keys: []jwk{}}
+	for _, k := range j.keys { set.Keys = append(set.Keys, k.jwk()) }
+	sort.Slice(set.Keys, func(a, b int) bool { return set.Keys[a].Kid < set.Keys[b].Kid })
+	return set
+}
+
+// GenerateToken issues a short-lived access token for a session. Every
+// token gets its own jti; sid ties it to the session that can revoke it.
+func (j *JWTManager) GenerateToken(userID int64, role string, sessionID string) (string, error) {
+	now := time.Now()
 	claims := jwt.MapClaims{
-		"sub": userID,
-		"adm": isAdmin,
-		"exp": time.Now().Add(j.exp).Unix(),
+		"sub":  userID,
+		"role": role,
+		"sid": sessionID,
+		"jti": randomToken(16),
+		"iat": now.Unix(),
+		"exp": now.Add(j.exp).Unix(),
+	}
+	if j.dir == "" {
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(j.secret)
 	}
-	t := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return t.SignedString(j.secret)
+	k, err := j.signingKey()
+	if err != nil { return "", err }
+	t := jwt.NewWithClaims(k.method, claims)
+	t.Header["kid"] = k.kid
+	return t.SignedString(k.private)
 }
 
 func (j *JWTManager) ParseToken(tokenStr string) (jwt.MapClaims, error) {
-	token, err := jwt.Parse(tokenStr, func(t *jwt.Token) (interface{}, error) {
-		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, errors.New("unexpected signing method")
-		}
-		return j.secret, nil
-	})
+	token, err := jwt.Parse(tokenStr, j.verificationKey)
 	if err != nil {
 		return nil, err
 	}
@@ -60,15 +142,50 @@ func (j *JWTManager) ParseToken(tokenStr string) (jwt.MapClaims, error) {
 	return nil, errors.New("invalid token")
 }
 
+func (j *JWTManager) verificationKey(t *jwt.Token) (interface{}, error) {
+	if j.dir == "" {
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, errors.New("unexpected signing method")
+		}
+		return j.secret, nil
+	}
+	kid, _ := t.Header["kid"].(string)
+	j.mu.RLock()
+	k := j.keys[kid]
+	j.mu.RUnlock()
+	if k == nil { return nil, errors.New("unknown signing key") }
+	if t.Method.Alg() != k.method.Alg() { return nil, errors.New("unexpected signing method") }
+	return k.public, nil
+}
+
 // Context keys
 
 type ctxKey string
 
 const (
-	ctxUserIDKey ctxKey = "user_id"
+	ctxUserIDKey      ctxKey = "user_id"
+	ctxSessionIDKey   ctxKey = "session_id"
+	ctxSessionUserKey ctxKey = "session_user"
+	ctxPermissionsKey ctxKey = "permissions"
 )
 
-func JWTAuthMiddleware(j *JWTManager) func(http.Handler) http.Handler {
+// currentUserID returns the authenticated user of a request, if any.
+func currentUserID(r *http.Request) *int64 {
+	if id, ok := r.Context().Value(ctxUserIDKey).(int64); ok && id != 0 { return &id }
+	return nil
+}
+
+// currentSessionID returns the session of the access token of a request.
+func currentSessionID(r *http.Request) string {
+	sid, _ := r.Context().Value(ctxSessionIDKey).(string)
+	return sid
+}
+
+// JWTAuthMiddleware accepts access tokens whose session is still active, so
+// logging out or revoking a session takes effect before the tokens expire.
+// The same lookup yields the current role of the user, which
+// RequirePermission checks. Bearer values starting with mk_ are API keys.
+func JWTAuthMiddleware(j *JWTManager, sessions *SessionService, apiKeys *APIKeyService) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			auth := r.Header.Get("Authorization")
@@ -77,6 +194,14 @@ func JWTAuthMiddleware(j *JWTManager) func(http.Handler) http.Handler {
 				return
 			}
 			tok := strings.TrimPrefix(auth, "Bearer ")
+			if strings.HasPrefix(tok, apiKeyPrefix) {
+				userID, u, err := apiKeys.Authenticate(r.Context(), tok)
+				if errors.Is(err, ErrInvalidAPIKey) { writeJSON(w, http.StatusUnauthorized, map[string]string{"error": err.Error()}); return }
+				if err != nil { writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()}); return }
+				ctx := context.WithValue(r.Context(), ctxUserIDKey, userID)
+				next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, ctxSessionUserKey, u)))
+				return
+			}
 			claims, err := j.ParseToken(tok)
 			if err != nil {
 				writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid token"})
@@ -87,27 +212,96 @@ func JWTAuthMiddleware(j *JWTManager) func(http.Handler) http.Handler {
 				writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid subject"})
 				return
 			}
-			r = r.WithContext(context.WithValue(r.Context(), ctxUserIDKey, int64(idF)))
+			sid, _ := claims["sid"].(string)
+			if sid == "" {
+				writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid token"})
+				return
+			}
+			u, err := sessions.Active(r.Context(), sid)
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			if u == nil {
+				writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "token revoked"})
+				return
+			}
+			ctx := context.WithValue(r.Context(), ctxUserIDKey, int64(idF))
+			ctx = context.WithValue(ctx, ctxSessionIDKey, sid)
+			r = r.WithContext(context.WithValue(ctx, ctxSessionUserKey, u))
 			next.ServeHTTP(w, r)
 		})
 	}
 }
 
-func AdminOnlyMiddleware(userService *UserService) func(http.Handler) http.Handler {
+// RequirePermission lets a request through when the role of its user has
+// any of perms; users who have not verified their email, and admins who
+// still have to enable a required second factor, have none. Requests made
+// with an API key only get the permissions among its scopes. It must
+// run after JWTAuthMiddleware; the permissions it loads stay in the context
+// for hasPermission.
+func RequirePermission(roles *RoleService, perms ...string) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			v := r.Context().Value(ctxUserIDKey)
-			userID, ok := v.(int64)
-			if !ok || userID == 0 {
+			u, _ := r.Context().Value(ctxSessionUserKey).(*sessionUser)
+			if u == nil {
 				writeJSON(w, http.StatusForbidden, map[string]string{"error": "forbidden"})
 				return
 			}
-			u, err := userService.GetByID(r.Context(), userID)
-			if err != nil || !u.IsAdmin {
-				writeJSON(w, http.StatusForbidden, map[string]string{"error": "admin only"})
+			if !u.Verified {
+				writeJSON(w, http.StatusForbidden, map[string]string{"error": "email not verified"})
 				return
 			}
-			next.ServeHTTP(w, r)
+			if u.NeedsTOTP {
+				writeJSON(w, http.StatusForbidden, map[string]string{"error": "two-factor authentication must be enabled"})
+				return
+			}
+			have, err := roles.Permissions(r.Context(), u.Role)
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			if u.Scopes != nil {
+				scoped := map[string]bool{}
+				for p := range have { scoped[p] = u.Scopes[p] }
+				have = scoped
+			}
+			for _, p := range perms {
+				if have[p] {
+					next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxPermissionsKey, have)))
+					return
+				}
+			}
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "missing permission " + strings.Join(perms, " or ")})
 		})
 	}
-}
\ No newline at end of file
+}
+
+// SessionOnly refuses requests authenticated with an API key, for the
+// endpoints that manage credentials: a leaked key must not be enough to
+// take over the account.
+func SessionOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u, _ := r.Context().Value(ctxSessionUserKey).(*sessionUser); u == nil || u.Scopes != nil {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "not allowed with an API key"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// hasPermission reports whether the user of a request has perm, as loaded
+// by RequirePermission.
+func hasPermission(r *http.Request, perm string) bool {
+	have, _ := r.Context().Value(ctxPermissionsKey).(map[string]bool)
+	return have[perm]
+}
+
+// hasPermissions reports whether the user of a request has all of perms;
+// it keeps users from granting more than they hold themselves.
+func hasPermissions(r *http.Request, perms []string) bool {
+	for _, p := range perms {
+		if !hasPermission(r, p) { return false }
+	}
+	return true
+}
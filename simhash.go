@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"math/bits"
+	"strings"
+	"unicode"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// shingleSize is the number of consecutive words hashed together, so
+	// that word order counts and texts sharing a vocabulary but not
+	// sentences stay apart.
+	shingleSize = 3
+	// minShingles is the least amount of text worth fingerprinting; shorter
+	// posts produce too few features for SimHash to be meaningful.
+	minShingles = 8
+	// maxSimhashDistance is the largest number of differing fingerprint bits
+	// at which two posts are still considered the same story. Unrelated
+	// texts differ in about 32 bits; in a feed item of a few sentences one
+	// edited word moves 3 to 7. It must stay below simhashBands, so that
+	// fingerprints this close always share a band.
+	maxSimhashDistance = 7
+	// simhashBands is how many parts a fingerprint is split into for the
+	// candidate lookup; a random post shares one of its 8-bit bands with
+	// about 3% of the others.
+	simhashBands    = 8
+	simhashBandBits = 64 / simhashBands
+)
+
+// simhash computes a 64-bit SimHash of text over word shingles. Words are
+// lowercased and stripped of punctuation first, so re-punctuated or
+// slightly reworded copies land a few bits apart. It returns 0 (never a
+// valid fingerprint) for texts too short to fingerprint.
+func simhash(text string) int64 {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) })
+	n := len(words) - shingleSize + 1
+	if n < minShingles { return 0 }
+	var weights [64]int
+	for i := 0; i < n; i++ {
+		h := fnv.New64a()
+		h.Write([]byte(strings.Join(words[i:i+shingleSize], " ")))
+		sum := h.Sum64()
+		for b := 0; b < 64; b++ {
+			if sum&(1<<b) != 0 { weights[b]++ } else { weights[b]-- }
+		}
+	}
+	var fp uint64
+	for b := 0; b < 64; b++ {
+		if weights[b] > 0 { fp |= 1 << b }
+	}
+	if fp == 0 { fp = 1 }
+	return int64(fp)
+}
+
+func simhashDistance(a, b int64) int { return bits.OnesCount64(uint64(a ^ b)) }
+
+// simhashBandKeys splits a fingerprint into its bands, each tagged
+// with its position, as stored in posts.fingerprint_bands. Two fingerprints
+// within maxSimhashDistance bits have at least one key in common. Fingerprint
+// 0 has no keys.
+func simhashBandKeys(fp int64) []int64 {
+	keys := []int64{}
+	if fp == 0 { return keys }
+	for i := 0; i < simhashBands; i++ {
+		keys = append(keys, int64(i)<<simhashBandBits|int64(uint64(fp)>>(simhashBandBits*i)&(1<<simhashBandBits-1)))
+	}
+	return keys
+}
+
+// findPostCluster returns the cluster of the closest recent post whose
+// fingerprint is within maxSimhashDistance of fp, or 0 if there is none.
+// Candidates are the posts sharing a band with fp, found through the index
+// on fingerprint_bands.
+func findPostCluster(ctx context.Context, q querier, fp int64, postID int64) (int64, error) {
+	rows, err := q.QueryContext(ctx, `SELECT COALESCE(cluster_id, id), fingerprint FROM posts
+		WHERE fingerprint_bands && $2::integer[] AND deleted_at IS NULL AND id <> $1 AND created_at > NOW() - INTERVAL '72 hours'`,
+		postID, pq.Array(simhashBandKeys(fp)))
+	if err != nil { return 0, err }
+	defer rows.Close()
+	var cluster int64
+	best := maxSimhashDistance + 1
+	for rows.Next() {
+		var c, other int64
+		if err := rows.Scan(&c, &other); err != nil { return 0, err }
+		if d := simhashDistance(fp, other); d < best { best, cluster = d, c }
+	}
+	return cluster, rows.Err()
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const simhashStory = `Национальный банк Казахстана в пятницу сохранил базовую ставку на уровне
+14,75 процента годовых. Регулятор объяснил решение замедлением инфляции и ослаблением
+давления на тенге. Следующее решение по ставке будет объявлено в начале следующего месяца,
+сообщили в пресс-службе банка. Аналитики ожидали именно такого решения и считают, что
+снижение ставки возможно уже до конца года, если инфляция продолжит замедляться.`
+
+func TestSimhashDistance(t *testing.T) {
+	tests := []struct {
+		a, b int64
+		want int
+	}{
+		{0, 0, 0},
+		{1, 0, 1},
+		{-1, 0, 64},
+		{0x0f0f, 0x00ff, 8},
+		{-1 << 63, 1 << 62, 2},
+	}
+	for _, tt := range tests {
+		if got := simhashDistance(tt.a, tt.b); got != tt.want { t.Errorf("simhashDistance(%x, %x) = %d, want %d", tt.a, tt.b, got, tt.want) }
+		if got := simhashDistance(tt.b, tt.a); got != tt.want { t.Errorf("simhashDistance is not symmetric for %x, %x", tt.a, tt.b) }
+	}
+}
+
+func TestSimhashShortText(t *testing.T) {
+	tests := []string{"", "Одно слово", strings.Repeat("слово ", shingleSize+minShingles-2), "!!! ??? ..."}
+	for _, in := range tests {
+		if got := simhash(in); got != 0 { t.Errorf("simhash(%q) = %x, want 0", in, got) }
+	}
+	if simhash(strings.Repeat("слово ", shingleSize+minShingles-1)) == 0 { t.Error("text of minShingles shingles got no fingerprint") }
+}
+
+func TestSimhashNearDuplicates(t *testing.T) {
+	fp := simhash(simhashStory)
+	if fp == 0 { t.Fatal("no fingerprint for the story") }
+	near := map[string]string{
+		"identical":        simhashStory,
+		"case and spacing": strings.ToUpper(strings.Join(strings.Fields(simhashStory), "   ")),
+		"punctuation":      strings.NewReplacer(",", "", ".", "!", "-", " ").Replace(simhashStory),
+		"one word changed": strings.Replace(simhashStory, "пятницу", "четверг", 1),
+	}
+	for name, text := range near {
+		if d := simhashDistance(fp, simhash(text)); d > maxSimhashDistance { t.Errorf("%s: distance %d, want at most %d", name, d, maxSimhashDistance) }
+	}
+	far := map[string]string{
+		"unrelated": `Футбольный клуб Кайрат обыграл соперника на своём поле со счётом три один и
+			вышел на первое место в турнирной таблице чемпионата страны после двадцати туров.`,
+		// Shingles keep word order: the same vocabulary in another order is a
+		// different text.
+		"same words reordered": reverseWords(simhashStory),
+	}
+	for name, text := range far {
+		if d := simhashDistance(fp, simhash(text)); d <= maxSimhashDistance { t.Errorf("%s: distance %d, want more than %d", name, d, maxSimhashDistance) }
+	}
+}
+
+func reverseWords(s string) string {
+	w := strings.Fields(s)
+	for i, j := 0, len(w)-1; i < j; i, j = i+1, j-1 { w[i], w[j] = w[j], w[i] }
+	return strings.Join(w, " ")
+}
+
+func TestSimhashBandKeys(t *testing.T) {
+	if keys := simhashBandKeys(0); len(keys) != 0 { t.Errorf("simhashBandKeys(0) = %v, want none", keys) }
+	keys := simhashBandKeys(int64(0x0123456789abcdef) ^ -1<<63)
+	want := []int64{0xef, 1<<8 | 0xcd, 2<<8 | 0xab, 3<<8 | 0x89, 4<<8 | 0x67, 5<<8 | 0x45, 6<<8 | 0x23, 7<<8 | 0x81}
+	if len(keys) != len(want) { t.Fatalf("got %d keys, want %d", len(keys), len(want)) }
+	for i := range want {
+		if keys[i] != want[i] { t.Errorf("key %d = %x, want %x", i, keys[i], want[i]) }
+		// The keys are stored in an INTEGER[] column.
+		if keys[i] < 0 || keys[i] > 1<<31-1 { t.Errorf("key %d = %x does not fit an integer", i, keys[i]) }
+	}
+}
+
+// TestSimhashBandsFindNearFingerprints checks the pigeonhole property the
+// candidate lookup relies on: fingerprints at most maxSimhashDistance bits
+// apart share a band key.
+func TestSimhashBandsFindNearFingerprints(t *testing.T) {
+	if maxSimhashDistance >= simhashBands { t.Fatalf("maxSimhashDistance %d must be below simhashBands %d", maxSimhashDistance, simhashBands) }
+	fp := int64(0x5a5a_1234_ffff_0001)
+	// Spread the flipped bits over as many bands as possible.
+	for _, bits := range [][]int{{0}, {0, 8}, {0, 8, 16, 24, 32, 40, 48}, {7, 15, 23, 31, 39, 47, 63}, {1, 2, 3, 4, 5, 6, 7}} {
+		other := fp
+		for _, b := range bits { other ^= 1 << b }
+		shared := false
+		for _, a := range simhashBandKeys(fp) {
+			for _, b := range simhashBandKeys(other) {
+				if a == b { shared = true }
+			}
+		}
+		if !shared { t.Errorf("flipping bits %v leaves no band in common", bits) }
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	// sitemapPageSize is the most URLs one sitemap file may hold.
+	sitemapPageSize = 50000
+	// newsSitemapWindow and maxNewsSitemapPosts follow the Google News
+	// sitemap limits.
+	newsSitemapWindow   = 48 * time.Hour
+	maxNewsSitemapPosts = 1000
+	// sitemapCacheTTL bounds staleness the change hooks cannot see, such as
+	// posts ageing out of the news window.
+	sitemapCacheTTL = time.Hour
+)
+
+// CountPublished returns the number of live published posts.
+func (s *PostService) CountPublished(ctx context.Context) (int, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM posts WHERE status = 'published' AND deleted_at IS NULL").Scan(&n)
+	return n, err
+}
+
+// ListPublishedPage returns the live published posts in id order, a page of
+// limit posts at a time; only the fields needed for links are loaded.
+func (s *PostService) ListPublishedPage(ctx context.Context, offset, limit int) ([]*Post, error) {
+	return s.listLinks(ctx, `SELECT id, COALESCE(slug, ''), title, published_at, created_at, updated_at FROM posts
+		WHERE status = 'published' AND deleted_at IS NULL ORDER BY id LIMIT $1 OFFSET $2`, limit, offset)
+}
+
+// ListPublishedSince returns the live posts published after since, newest first.
+func (s *PostService) ListPublishedSince(ctx context.Context, since time.Time, limit int) ([]*Post, error) {
+	return s.listLinks(ctx, `SELECT id, COALESCE(slug, ''), title, published_at, created_at, updated_at FROM posts
+		WHERE status = 'published' AND deleted_at IS NULL AND COALESCE(published_at, created_at) > $2
+		ORDER BY COALESCE(published_at, created_at) DESC, id DESC LIMIT $1`, limit, since)
+}
+
+func (s *PostService) listLinks(ctx context.Context, query string, args ...any) ([]*Post, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil { return nil, err }
+	defer rows.Close()
+	var posts []*Post
+	for rows.Next() {
+		p := &Post{}
+		if err := rows.Scan(&p.ID, &p.Slug, &p.Title, &p.PublishedAt, &p.CreatedAt, &p.UpdatedAt); err != nil { return nil, err }
+		posts = append(posts, p)
+	}
+	return posts, rows.Err()
+}
+
+type sitemapDoc struct {
+	body []byte
+	etag string
+	at   time.Time
+}
+
+// sitemapCache keeps rendered sitemaps until posts change or they expire.
+// gen counts invalidations, so a build that overlaps one is not stored.
+type sitemapCache struct {
+	mu   sync.Mutex
+	docs map[string]*sitemapDoc
+	gen  uint64
+}
+
+func (c *sitemapCache) invalidate() {
+	c.mu.Lock()
+	c.docs = nil
+	c.gen++
+	c.mu.Unlock()
+}
+
+// get returns the cached document for key, building it on a miss. Concurrent
+// misses may build the same document twice. A document whose build began
+// before an invalidation is served to its caller but not cached, since it
+// may miss the change.
+func (c *sitemapCache) get(key string, build func() (any, error)) (*sitemapDoc, error) {
+	c.mu.Lock()
+	d := c.docs[key]
+	gen := c.gen
+	c.mu.Unlock()
+	if d != nil && time.Since(d.at) < sitemapCacheTTL { return d, nil }
+	v, err := build()
+	if err != nil { return nil, err }
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	if err := xml.NewEncoder(&buf).Encode(v); err != nil { return nil, err }
+	sum := sha1.Sum(buf.Bytes())
+	d = &sitemapDoc{body: buf.Bytes(), etag: `"` + hex.EncodeToString(sum[:10]) + `"`, at: time.Now()}
+	c.mu.Lock()
+	if c.gen == gen {
+		if c.docs == nil { c.docs = map[string]*sitemapDoc{} }
+		c.docs[key] = d
+	}
+	c.mu.Unlock()
+	return d, nil
+}
+
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+	NewsNS  string       `xml:"xmlns:news,attr,omitempty"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapURL struct {
+	Loc     string       `xml:"loc"`
+	LastMod string       `xml:"lastmod,omitempty"`
+	News    *sitemapNews `xml:"news:news"`
+}
+
+type sitemapNews struct {
+	Name            string `xml:"news:publication>news:name"`
+	Language        string `xml:"news:publication>news:language"`
+	PublicationDate string `xml:"news:publication_date"`
+	Title           string `xml:"news:title"`
+}
+
+type sitemapIndex struct {
+	XMLName  xml.Name        `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 sitemapindex"`
+	Sitemaps []sitemapIndexRef `xml:"sitemap"`
+}
+
+type sitemapIndexRef struct {
+	Loc string `xml:"loc"`
+}
+
+type SitemapHandler struct {
+	posts *PostService
+	site  Site
+	cache *sitemapCache
+}
+
+// NewSitemapHandler creates the handler and hooks its cache to post changes.
+func NewSitemapHandler(posts *PostService, site Site) *SitemapHandler {
+	h := &SitemapHandler{posts: posts, site: site, cache: &sitemapCache{}}
+	posts.OnChange(h.cache.invalidate)
+	return h
+}
+
+func (h *SitemapHandler) write(w http.ResponseWriter, r *http.Request, d *sitemapDoc, err error) {
+	if errors.Is(err, ErrNotFound) { writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"}); return }
+	if err != nil { writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()}); return }
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.Header().Set("ETag", d.etag)
+	w.Header().Set("Cache-Control", "public, max-age=600")
+	if etagMatches(r.Header.Get("If-None-Match"), d.etag) { w.WriteHeader(http.StatusNotModified); return }
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(d.body)
+}
+
+// HandleIndex serves /sitemap.xml: the posts themselves while they fit in
+// one file, otherwise an index of /sitemap-posts-{n}.xml pages.
+func (h *SitemapHandler) HandleIndex(w http.ResponseWriter, r *http.Request) {
+	d, err := h.cache.get("index", func() (any, error) {
+		n, err := h.posts.CountPublished(r.Context())
+		if err != nil { return nil, err }
+		if n <= sitemapPageSize { return h.buildPage(r.Context(), 1) }
+		idx := sitemapIndex{}
+		for page := 1; (page-1)*sitemapPageSize < n; page++ {
+			idx.Sitemaps = append(idx.Sitemaps, sitemapIndexRef{Loc: h.site.URL + "/sitemap-posts-" + strconv.Itoa(page) + ".xml"})
+		}
+		return idx, nil
+	})
+	h.write(w, r, d, err)
+}
+
+func (h *SitemapHandler) HandlePage(w http.ResponseWriter, r *http.Request) {
+	page, err := strconv.Atoi(chi.URLParam(r, "page"))
+	if err != nil || page < 1 { writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"}); return }
+	d, err := h.cache.get("posts-"+strconv.Itoa(page), func() (any, error) { return h.buildPage(r.Context(), page) })
+	h.write(w, r, d, err)
+}
+
+func (h *SitemapHandler) buildPage(ctx context.Context, page int) (any, error) {
+	posts, err := h.posts.ListPublishedPage(ctx, (page-1)*sitemapPageSize, sitemapPageSize)
+	if err != nil { return nil, err }
+	if len(posts) == 0 && page > 1 { return nil, ErrNotFound }
+	set := sitemapURLSet{}
+	for _, p := range posts {
+		set.URLs = append(set.URLs, sitemapURL{Loc: h.site.PostURL(p), LastMod: p.UpdatedAt.UTC().Format(time.RFC3339)})
+	}
+	return set, nil
+}
+
+// HandleNews serves /sitemap-news.xml with the posts of the last 48 hours.
+func (h *SitemapHandler) HandleNews(w http.ResponseWriter, r *http.Request) {
+	d, err := h.cache.get("news", func() (any, error) {
+		posts, err := h.posts.ListPublishedSince(r.Context(), time.Now().Add(-newsSitemapWindow), maxNewsSitemapPosts)
+		if err != nil { return nil, err }
+		set := sitemapURLSet{NewsNS: "http://www.google.com/schemas/sitemap-news/0.9"}
+		for _, p := range posts {
+			set.URLs = append(set.URLs, sitemapURL{Loc: h.site.PostURL(p), News: &sitemapNews{
+				Name:            h.site.Title,
+				Language:        h.site.Language,
+				PublicationDate: postDate(p).UTC().Format(time.RFC3339),
+				Title:           p.Title,
+			}})
+		}
+		return set, nil
+	})
+	h.write(w, r, d, err)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/lib/pq"
+)
+
+const maxSlugLen = 80
+
+// translit spells Cyrillic letters (Russian and Kazakh) in Latin, roughly
+// following the passport transliteration rules.
+var translit = map[rune]string{
+	'а': "a", 'б': "b", 'в': "v", 'г': "g", 'д': "d", 'е': "e", 'ё': "e", 'ж': "zh",
+	'з': "z", 'и': "i", 'й': "i", 'к': "k", 'л': "l", 'м': "m", 'н': "n", 'о': "o",
+	'п': "p", 'р': "r", 'с': "s", 'т': "t", 'у': "u", 'ф': "f", 'х': "kh", 'ц': "ts",
+	'ч': "ch", 'ш': "sh", 'щ': "shch", 'ъ': "", 'ы': "y", 'ь': "", 'э': "e", 'ю': "iu",
+	'я': "ia", 'ә': "a", 'ғ': "g", 'қ': "q", 'ң': "n", 'ө': "o", 'ұ': "u", 'ү': "u",
+	'һ': "h", 'і': "i",
+}
+
+// slugify turns a title into a lowercase ASCII slug of letters, digits and
+// single hyphens. Letters without a Latin spelling are dropped.
+func slugify(title string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(title) {
+		s, ok := translit[r]
+		if !ok && (r < 128 && (unicode.IsLetter(r) || unicode.IsDigit(r))) { s, ok = string(r), true }
+		if !ok {
+			if !unicode.IsLetter(r) { dash = true }
+			continue
+		}
+		if s == "" { continue }
+		if dash && b.Len() > 0 { b.WriteByte('-') }
+		dash = false
+		b.WriteString(s)
+	}
+	slug := b.String()
+	if len(slug) > maxSlugLen {
+		slug = slug[:maxSlugLen]
+		if i := strings.LastIndexByte(slug, '-'); i > maxSlugLen/2 { slug = slug[:i] }
+	}
+	return strings.Trim(slug, "-")
+}
+
+// validSlug reports whether s could have come out of slugify.
+func validSlug(s string) bool {
+	return s != "" && len(s) <= maxSlugLen && slugify(s) == s
+}
+
+// isAutoSlug reports whether slug was generated from title (possibly with a
+// numeric suffix) rather than chosen by hand.
+func isAutoSlug(slug, title string) bool {
+	base := firstNonEmpty(slugify(title), "post")
+	if slug == base { return true }
+	n, err := strconv.Atoi(strings.TrimPrefix(slug, base+"-"))
+	return strings.HasPrefix(slug, base+"-") && err == nil && n > 1
+}
+
+// ErrSlugTaken is returned when a requested slug belongs to another post.
+var ErrSlugTaken = errors.New("slug is already taken")
+
+// postSlugAttempts bounds how often a post is inserted again after a
+// concurrent insert took the slug generated for it.
+const postSlugAttempts = 5
+
+// isSlugConflict reports whether err is the unique index on posts.slug
+// refusing a slug that another transaction took after it was checked.
+func isSlugConflict(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505" && pqErr.Constraint == "posts_slug_idx"
+}
+
+// slugTaken reports whether slug is used by a post other than postID, either
+// as its current slug or as a redirect.
+func slugTaken(ctx context.Context, q querier, slug string, postID int64) (bool, error) {
+	var taken bool
+	err := q.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM posts WHERE slug = $1 AND id <> $2)
+		OR EXISTS (SELECT 1 FROM post_slug_redirects WHERE slug = $1 AND post_id <> $2)`, slug, postID).Scan(&taken)
+	return taken, err
+}
+
+// uniquePostSlug derives a slug from title that no other post uses, adding
+// -2, -3, ... to the base slug as needed.
+func uniquePostSlug(ctx context.Context, q querier, title string, postID int64) (string, error) {
+	base := firstNonEmpty(slugify(title), "post")
+	rows, err := q.QueryContext(ctx, `SELECT slug FROM posts WHERE (slug = $1 OR slug LIKE $1 || '-%') AND id <> $2
+		UNION SELECT slug FROM post_slug_redirects WHERE (slug = $1 OR slug LIKE $1 || '-%') AND post_id <> $2`, base, postID)
+	if err != nil { return "", err }
+	defer rows.Close()
+	used := map[string]bool{}
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil { return "", err }
+		used[s] = true
+	}
+	if err := rows.Err(); err != nil { return "", err }
+	slug := base
+	for n := 2; used[slug]; n++ { slug = base + "-" + strconv.Itoa(n) }
+	return slug, nil
+}
+
+// resolvePostSlug picks the slug a post should get: the requested one if it
+// is free, otherwise one derived from the title.
+func resolvePostSlug(ctx context.Context, q querier, requested, title string, postID int64) (string, error) {
+	if requested == "" { return uniquePostSlug(ctx, q, title, postID) }
+	if !validSlug(requested) { return "", errors.New("slug may only contain lowercase latin letters, digits and hyphens") }
+	taken, err := slugTaken(ctx, q, requested, postID)
+	if err != nil { return "", err }
+	if taken { return "", ErrSlugTaken }
+	return requested, nil
+}
+
+// changePostSlug keeps the old slug of a post as a redirect to it. A
+// redirect for the new slug is dropped since the slug is live again.
+func changePostSlug(ctx context.Context, q querier, postID int64, oldSlug, newSlug string) error {
+	if oldSlug == newSlug { return nil }
+	if _, err := q.ExecContext(ctx, "DELETE FROM post_slug_redirects WHERE slug = $1", newSlug); err != nil { return err }
+	if oldSlug == "" { return nil }
+	_, err := q.ExecContext(ctx, `INSERT INTO post_slug_redirects (slug, post_id) VALUES ($1, $2)
+		ON CONFLICT (slug) DO UPDATE SET post_id = EXCLUDED.post_id, created_at = NOW()`, oldSlug, postID)
+	return err
+}
+
+// backfillPostSlugs assigns slugs to posts created before slugs existed.
+func backfillPostSlugs(ctx context.Context, db DB) error {
+	for {
+		rows, err := db.QueryContext(ctx, "SELECT id, title FROM posts WHERE slug IS NULL ORDER BY id LIMIT 500")
+		if err != nil { return err }
+		titles := map[int64]string{}
+		var ids []int64
+		for rows.Next() {
+			var id int64
+			var title string
+			if err := rows.Scan(&id, &title); err != nil { rows.Close(); return err }
+			ids = append(ids, id)
+			titles[id] = title
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil { return err }
+		if len(ids) == 0 { return nil }
+		for _, id := range ids {
+			err := withTx(ctx, db, func(tx *sql.Tx) error {
+				slug, err := uniquePostSlug(ctx, tx, titles[id], id)
+				if err != nil { return err }
+				_, err = tx.ExecContext(ctx, "UPDATE posts SET slug = $1 WHERE id = $2", slug, id)
+				return err
+			})
+			if err != nil { return err }
+		}
+	}
+}
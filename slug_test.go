@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+func TestSlugify(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"", ""},
+		{"Hello, World!", "hello-world"},
+		{"Курс тенге вырос", "kurs-tenge-vyros"},
+		{"Щука и ёж", "shchuka-i-ezh"},
+		{"Объявление", "obiavlenie"},
+		{"Подъезд", "podezd"},
+		{"Қазақстан Республикасы", "qazaqstan-respublikasy"},
+		{"Өскемен, Үржар, Һ і ә ғ ң ұ", "oskemen-urzhar-h-i-a-g-n-u"},
+		{"  --Много   пробелов--  ", "mnogo-probelov"},
+		{"2024: итоги года", "2024-itogi-goda"},
+		{"Straße und Café", "strae-und-caf"},
+		{"東京 news", "news"},
+		{"!!!", ""},
+	}
+	for _, tt := range tests {
+		if got := slugify(tt.in); got != tt.want { t.Errorf("slugify(%q) = %q, want %q", tt.in, got, tt.want) }
+	}
+}
+
+func TestSlugifyMaxLength(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		// Cut back to the last word boundary.
+		{strings.Repeat("word ", 30), strings.TrimSuffix(strings.Repeat("word-", 16), "-")},
+		// A single long word is cut where the limit falls.
+		{strings.Repeat("a", maxSlugLen+20), strings.Repeat("a", maxSlugLen)},
+		// Transliterated letters count by their Latin spelling.
+		{strings.Repeat("щ", 30), strings.Repeat("shch", maxSlugLen/4)},
+	}
+	for _, tt := range tests {
+		got := slugify(tt.in)
+		if got != tt.want { t.Errorf("slugify(%q) = %q, want %q", tt.in, got, tt.want) }
+		if len(got) > maxSlugLen { t.Errorf("slugify(%q) is %d bytes long", tt.in, len(got)) }
+	}
+}
+
+func TestTranslitCoversAlphabets(t *testing.T) {
+	for _, r := range "абвгдеёжзийклмнопрстуфхцчшщъыьэюяәғқңөұүһі" {
+		s, ok := translit[r]
+		if !ok { t.Errorf("no transliteration for %q", r); continue }
+		for _, c := range s {
+			if c < 'a' || c > 'z' { t.Errorf("translit[%q] = %q is not lowercase latin", r, s) }
+		}
+	}
+}
+
+func TestValidSlug(t *testing.T) {
+	tests := map[string]bool{
+		"kurs-tenge": true, "2024": true, "a": true,
+		"": false, "Kurs": false, "kurs--tenge": false, "-kurs": false, "kurs-": false, "курс": false, "kurs tenge": false,
+		strings.Repeat("a", maxSlugLen): true, strings.Repeat("a", maxSlugLen+1): false,
+	}
+	for s, want := range tests {
+		if got := validSlug(s); got != want { t.Errorf("validSlug(%q) = %v, want %v", s, got, want) }
+	}
+}
+
+func TestIsAutoSlug(t *testing.T) {
+	tests := []struct {
+		slug, title string
+		want        bool
+	}{
+		{"kurs-tenge", "Курс тенге", true},
+		{"kurs-tenge-2", "Курс тенге", true},
+		{"kurs-tenge-17", "Курс тенге", true},
+		{"kurs-tenge-1", "Курс тенге", false},
+		{"kurs-tenge-x", "Курс тенге", false},
+		{"tenge", "Курс тенге", false},
+		{"post", "!!!", true},
+		{"post-3", "!!!", true},
+	}
+	for _, tt := range tests {
+		if got := isAutoSlug(tt.slug, tt.title); got != tt.want {
+			t.Errorf("isAutoSlug(%q, %q) = %v, want %v", tt.slug, tt.title, got, tt.want)
+		}
+	}
+}
+
+func TestIsSlugConflict(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{errors.New("posts_slug_idx"), false},
+		{&pq.Error{Code: "23505", Constraint: "posts_slug_idx"}, true},
+		{fmt.Errorf("insert: %w", &pq.Error{Code: "23505", Constraint: "posts_slug_idx"}), true},
+		{&pq.Error{Code: "23505", Constraint: "post_slug_redirects_pkey"}, false},
+		{&pq.Error{Code: "23503", Constraint: "posts_slug_idx"}, false},
+	}
+	for _, tt := range tests {
+		if got := isSlugConflict(tt.err); got != tt.want { t.Errorf("isSlugConflict(%v) = %v, want %v", tt.err, got, tt.want) }
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// storyWindow is how long a story keeps accepting posts after its latest one.
+	storyWindow = 24 * time.Hour
+	// minStoryOverlap is the number of keywords a post must share with a
+	// story to join it.
+	minStoryOverlap = 3
+)
+
+// postKeywordsExpr picks the most prominent lexemes of a post from its
+// Russian search vector (which also stems English words): title words
+// count triple, numbers and very short words are skipped.
+const postKeywordsExpr = `ARRAY(SELECT k.lexeme FROM unnest(search_ru) k
+	WHERE char_length(k.lexeme) >= 3 AND k.lexeme !~ '^[0-9]+$'
+	ORDER BY cardinality(k.positions) + 2 * cardinality(array_positions(k.weights, 'A')) DESC, k.lexeme
+	LIMIT 8)`
+
+// updatePostKeywords recomputes the keywords of a post and returns them.
+func updatePostKeywords(ctx context.Context, q querier, postID int64) ([]string, error) {
+	var kw []string
+	err := q.QueryRowContext(ctx, "UPDATE posts SET keywords = "+postKeywordsExpr+" WHERE id = $1 RETURNING keywords", postID).
+		Scan(pq.Array(&kw))
+	return kw, err
+}
+
+// assignStory puts a new post into a story: the story of its near-duplicate
+// cluster if it has one, else the recently active story sharing the most
+// keywords with it, else a new story named after the post.
+func assignStory(ctx context.Context, q querier, postID, clusterID int64, title string, keywords []string) error {
+	var storyID sql.NullInt64
+	if clusterID != postID {
+		err := q.QueryRowContext(ctx, "SELECT story_id FROM posts WHERE id = $1", clusterID).Scan(&storyID)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) { return err }
+	}
+	if !storyID.Valid && len(keywords) >= minStoryOverlap {
+		err := q.QueryRowContext(ctx, `SELECT s.id FROM stories s
+			CROSS JOIN LATERAL (SELECT COUNT(*) AS n FROM unnest(s.keywords) k WHERE k = ANY($1)) o
+			WHERE s.last_seen_at > NOW() - make_interval(secs => $2) AND s.keywords && $1 AND o.n >= $3
+			ORDER BY o.n DESC, s.last_seen_at DESC LIMIT 1`,
+			pq.Array(keywords), storyWindow.Seconds(), minStoryOverlap).Scan(&storyID)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) { return err }
+	}
+	if storyID.Valid {
+		if _, err := q.ExecContext(ctx, "UPDATE stories SET last_seen_at = NOW(), post_count = post_count + 1 WHERE id = $1", storyID.Int64); err != nil {
+			return err
+		}
+	} else {
+		err := q.QueryRowContext(ctx, "INSERT INTO stories (title, keywords) VALUES ($1, COALESCE($2::text[], '{}')) RETURNING id", title, pq.Array(keywords)).Scan(&storyID)
+		if err != nil { return err }
+	}
+	_, err := q.ExecContext(ctx, "UPDATE posts SET story_id = $1 WHERE id = $2", storyID.Int64, postID)
+	return err
+}
+
+// TrendingStory is a story ranked by how many posts it got in a window.
+type TrendingStory struct {
+	ID        int64            `json:"id"`
+	Title     string           `json:"title"`
+	Keywords  []string         `json:"keywords"`
+	PostCount int64            `json:"post_count"`
+	LatestAt  time.Time        `json:"latest_at"`
+	Sources   []TrendingSource `json:"sources"`
+}
+
+// TrendingSource counts the posts of a story from one feed; FeedID and
+// URL are empty for posts written by editors.
+type TrendingSource struct {
+	FeedID    *int64  `json:"feed_id"`
+	URL       *string `json:"url"`
+	PostCount int64   `json:"post_count"`
+}
+
+type TrendingKeyword struct {
+	Keyword   string `json:"keyword"`
+	PostCount int64  `json:"post_count"`
+}
+
+type Trending struct {
+	Stories  []*TrendingStory  `json:"stories"`
+	Keywords []TrendingKeyword `json:"keywords"`
+}
+
+type StoryService struct { db DB }
+
+func NewStoryService(db DB) *StoryService { return &StoryService{db: db} }
+
+// trendingPosts restricts posts p to published ones from the last $1 seconds.
+const trendingPosts = `p.status = 'published' AND p.deleted_at IS NULL
+	AND COALESCE(p.published_at, p.created_at) > NOW() - make_interval(secs => $1)`
+
+// Trending returns the stories and keywords with the most published posts
+// within window.
+func (s *StoryService) Trending(ctx context.Context, window time.Duration, limit int) (*Trending, error) {
+	t := &Trending{Stories: []*TrendingStory{}, Keywords: []TrendingKeyword{}}
+	rows, err := s.db.QueryContext(ctx, `SELECT st.id, st.title, st.keywords, COUNT(*), MAX(COALESCE(p.published_at, p.created_at))
+		FROM posts p JOIN stories st ON st.id = p.story_id
+		WHERE `+trendingPosts+`
+		GROUP BY st.id ORDER BY COUNT(*) DESC, MAX(COALESCE(p.published_at, p.created_at)) DESC LIMIT $2`, window.Seconds(), limit)
+	if err != nil { return nil, err }
+	byID := map[int64]*TrendingStory{}
+	var ids []int64
+	for rows.Next() {
+		st := &TrendingStory{Sources: []TrendingSource{}}
+		if err := rows.Scan(&st.ID, &st.Title, pq.Array(&st.Keywords), &st.PostCount, &st.LatestAt); err != nil { rows.Close(); return nil, err }
+		t.Stories = append(t.Stories, st)
+		byID[st.ID] = st
+		ids = append(ids, st.ID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil { return nil, err }
+
+	if len(ids) > 0 {
+		rows, err = s.db.QueryContext(ctx, `SELECT p.story_id, p.feed_id, f.url, COUNT(*)
+			FROM posts p LEFT JOIN feeds f ON f.id = p.feed_id
+			WHERE `+trendingPosts+` AND p.story_id = ANY($2)
+			GROUP BY p.story_id, p.feed_id, f.url ORDER BY COUNT(*) DESC, p.feed_id`, window.Seconds(), pq.Array(ids))
+		if err != nil { return nil, err }
+		for rows.Next() {
+			var storyID int64
+			var src TrendingSource
+			if err := rows.Scan(&storyID, &src.FeedID, &src.URL, &src.PostCount); err != nil { rows.Close(); return nil, err }
+			byID[storyID].Sources = append(byID[storyID].Sources, src)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil { return nil, err }
+	}
+
+	rows, err = s.db.QueryContext(ctx, `SELECT k, COUNT(*) FROM posts p, unnest(p.keywords) k
+		WHERE `+trendingPosts+`
+		GROUP BY k ORDER BY COUNT(*) DESC, k LIMIT $2`, window.Seconds(), limit)
+	if err != nil { return nil, err }
+	defer rows.Close()
+	for rows.Next() {
+		var k TrendingKeyword
+		if err := rows.Scan(&k.Keyword, &k.PostCount); err != nil { return nil, err }
+		t.Keywords = append(t.Keywords, k)
+	}
+	return t, rows.Err()
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Site describes the public website posts are published on.
+type Site struct {
+	URL            string
+	Title          string
+	Language       string
+	// Since dates the tag URI of the site's feed, empty if not configured.
+	Since          string
+	PostURLPattern string
+}
+
+func NewSite(cfg Config) Site {
+	return Site{URL: cfg.SiteURL, Title: cfg.SiteTitle, Language: cfg.SiteLanguage, Since: cfg.SiteSince, PostURLPattern: cfg.PostURLPattern}
+}
+
+// PostURL is the public address of a post.
+func (s Site) PostURL(p *Post) string {
+	return strings.NewReplacer("{slug}", url.PathEscape(p.Slug), "{id}", strconv.FormatInt(p.ID, 10)).Replace(s.PostURLPattern)
+}
+
+// PostGUID is a permanent tag URI (RFC 4151) identifying a post; unlike
+// its URL it survives slug and site changes.
+func (s Site) PostGUID(p *Post) string {
+	return fmt.Sprintf("tag:%s,%s:post:%d", s.host(), p.CreatedAt.UTC().Format("2006-01-02"), p.ID)
+}
+
+func (s Site) host() string {
+	if u, err := url.Parse(s.URL); err == nil && u.Hostname() != "" { return u.Hostname() }
+	return "localhost"
+}
+
+const maxSyndicatedPosts = 100
+
+// SyndicationHandler publishes the latest published posts as RSS 2.0,
+// Atom 1.0 and JSON Feed 1.1. Every filter of GET /posts is accepted.
+type SyndicationHandler struct {
+	posts *PostService
+	site  Site
+}
+
+func NewSyndicationHandler(posts *PostService, site Site) *SyndicationHandler {
+	return &SyndicationHandler{posts: posts, site: site}
+}
+
+// load fetches the posts of a feed request and handles conditional GET.
+// It returns ok=false when the response has already been written.
+func (h *SyndicationHandler) load(w http.ResponseWriter, r *http.Request, format string) (posts []*Post, updated time.Time, ok bool) {
+	params, err := parsePostListParams(r)
+	if err != nil { writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()}); return nil, updated, false }
+	params.Statuses = []string{PostStatusPublished}
+	params.Sort, params.Cursor = SortPublishedDesc, nil
+	params.Limit = min(params.Limit, maxSyndicatedPosts)
+	posts, _, err = h.posts.List(r.Context(), params)
+	if err != nil { writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()}); return nil, updated, false }
+
+	sum := sha1.New()
+	fmt.Fprintf(sum, "%s?%s", format, r.URL.RawQuery)
+	for _, p := range posts {
+		fmt.Fprintf(sum, ";%d-%d", p.ID, p.Version)
+		if p.UpdatedAt.After(updated) { updated = p.UpdatedAt }
+	}
+	if updated.IsZero() { updated = time.Now() }
+	updated = updated.UTC().Truncate(time.Second)
+	etag := `W/"` + hex.EncodeToString(sum.Sum(nil))[:20] + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", updated.Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if etagMatches(inm, etag) { w.WriteHeader(http.StatusNotModified); return nil, updated, false }
+	} else if t, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !updated.After(t) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil, updated, false
+	}
+	return posts, updated, true
+}
+
+// selfURL is the public address of the requested feed, query included.
+func (h *SyndicationHandler) selfURL(r *http.Request) string {
+	u := h.site.URL + r.URL.Path
+	if r.URL.RawQuery != "" { u += "?" + r.URL.RawQuery }
+	return u
+}
+
+func writeXML(w http.ResponseWriter, contentType string, v any) {
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte(xml.Header))
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	_ = enc.Encode(v)
+}
+
+type rssOut struct {
+	XMLName   xml.Name      `xml:"rss"`
+	Version   string        `xml:"version,attr"`
+	AtomNS    string        `xml:"xmlns:atom,attr"`
+	ContentNS string        `xml:"xmlns:content,attr"`
+	DCNS      string        `xml:"xmlns:dc,attr"`
+	Channel   rssOutChannel `xml:"channel"`
+}
+
+type rssOutChannel struct {
+	Title         string       `xml:"title"`
+	Link          string       `xml:"link"`
+	Description   string       `xml:"description"`
+	AtomLink      atomOutLink  `xml:"atom:link"`
+	LastBuildDate string       `xml:"lastBuildDate"`
+	Items         []rssOutItem `xml:"item"`
+}
+
+type rssOutGUID struct {
+	IsPermaLink string `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type rssOutItem struct {
+	Title       string     `xml:"title"`
+	Link        string     `xml:"link"`
+	GUID        rssOutGUID `xml:"guid"`
+	PubDate     string     `xml:"pubDate"`
+	Creator     string     `xml:"dc:creator,omitempty"`
+	Categories  []string   `xml:"category"`
+	Description string     `xml:"description"`
+	Content     string     `xml:"content:encoded"`
+}
+
+func (h *SyndicationHandler) HandleRSS(w http.ResponseWriter, r *http.Request) {
+	posts, updated, ok := h.load(w, r, "rss")
+	if !ok { return }
+	out := rssOut{
+		Version: "2.0", AtomNS: "http://www.w3.org/2005/Atom", ContentNS: "http://purl.org/rss/1.0/modules/content/", DCNS: "http://purl.org/dc/elements/1.1/",
+		Channel: rssOutChannel{
+			Title:         h.site.Title,
+			Link:          h.site.URL,
+			Description:   h.site.Title,
+			AtomLink:      atomOutLink{Href: h.selfURL(r), Rel: "self", Type: "application/rss+xml"},
+			LastBuildDate: updated.Format(time.RFC1123Z),
+			Items:         []rssOutItem{},
+		},
+	}
+	for _, p := range posts {
+		out.Channel.Items = append(out.Channel.Items, rssOutItem{
+			Title:       p.Title,
+			Link:        h.site.PostURL(p),
+			GUID:        rssOutGUID{IsPermaLink: "false", Value: h.site.PostGUID(p)},
+			PubDate:     postDate(p).Format(time.RFC1123Z),
+			Creator:     derefString(p.Author),
+			Categories:  p.Tags,
+			Description: p.Excerpt,
+			Content:     p.ContentHTML,
+		})
+	}
+	writeXML(w, "application/rss+xml; charset=utf-8", out)
+}
+
+type atomOut struct {
+	XMLName xml.Name       `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string         `xml:"id"`
+	Title   string         `xml:"title"`
+	Updated string         `xml:"updated"`
+	Links   []atomOutLink  `xml:"link"`
+	Entries []atomOutEntry `xml:"entry"`
+}
+
+type atomOutLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomOutText struct {
+	Type  string `xml:"type,attr,omitempty"`
+	Value string `xml:",chardata"`
+}
+
+type atomOutPerson struct {
+	Name string `xml:"name"`
+}
+
+type atomOutCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+type atomOutEntry struct {
+	ID         string            `xml:"id"`
+	Title      string            `xml:"title"`
+	Updated    string            `xml:"updated"`
+	Published  string            `xml:"published"`
+	Link       atomOutLink       `xml:"link"`
+	Authors    []atomOutPerson   `xml:"author"`
+	Categories []atomOutCategory `xml:"category"`
+	Summary    atomOutText       `xml:"summary"`
+	Content    atomOutText       `xml:"content"`
+}
+
+// feedID is the permanent tag URI of the Atom feed. Its date is Site.Since
+// or else the creation date of the first post, which does not change as
+// new posts come in.
+func (h *SyndicationHandler) feedID(r *http.Request) (string, error) {
+	since := h.site.Since
+	if since == "" {
+		first, err := h.posts.FirstCreatedAt(r.Context())
+		if err != nil { return "", err }
+		since = first.UTC().Format("2006-01-02")
+	}
+	return "tag:" + h.site.host() + "," + since + ":feed", nil
+}
+
+func (h *SyndicationHandler) HandleAtom(w http.ResponseWriter, r *http.Request) {
+	id, err := h.feedID(r)
+	if err != nil { writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()}); return }
+	posts, updated, ok := h.load(w, r, "atom")
+	if !ok { return }
+	out := atomOut{
+		ID:      id,
+		Title:   h.site.Title,
+		Updated: updated.Format(time.RFC3339),
+		Links: []atomOutLink{
+			{Href: h.selfURL(r), Rel: "self", Type: "application/atom+xml"},
+			{Href: h.site.URL, Rel: "alternate", Type: "text/html"},
+		},
+	}
+	for _, p := range posts {
+		e := atomOutEntry{
+			ID:        h.site.PostGUID(p),
+			Title:     p.Title,
+			Updated:   p.UpdatedAt.UTC().Format(time.RFC3339),
+			Published: postDate(p).UTC().Format(time.RFC3339),
+			Link:      atomOutLink{Href: h.site.PostURL(p), Rel: "alternate", Type: "text/html"},
+			Summary:   atomOutText{Value: p.Excerpt},
+			Content:   atomOutText{Type: "html", Value: p.ContentHTML},
+		}
+		// Entries without an author inherit none from the feed, which
+		// Atom requires, so fall back to the site name.
+		e.Authors = []atomOutPerson{{Name: firstNonEmpty(derefString(p.Author), h.site.Title)}}
+		for _, t := range p.Tags { e.Categories = append(e.Categories, atomOutCategory{Term: t}) }
+		out.Entries = append(out.Entries, e)
+	}
+	writeXML(w, "application/atom+xml; charset=utf-8", out)
+}
+
+type jsonFeed struct {
+	Version     string         `json:"version"`
+	Title       string         `json:"title"`
+	HomePageURL string         `json:"home_page_url"`
+	FeedURL     string         `json:"feed_url"`
+	Items       []jsonFeedItem `json:"items"`
+}
+
+type jsonFeedAuthor struct {
+	Name string `json:"name"`
+}
+
+type jsonFeedItem struct {
+	ID            string           `json:"id"`
+	URL           string           `json:"url"`
+	Title         string           `json:"title"`
+	ContentHTML   string           `json:"content_html"`
+	Summary       string           `json:"summary,omitempty"`
+	DatePublished string           `json:"date_published"`
+	DateModified  string           `json:"date_modified"`
+	Authors       []jsonFeedAuthor `json:"authors,omitempty"`
+	Tags          []string         `json:"tags,omitempty"`
+}
+
+func (h *SyndicationHandler) HandleJSON(w http.ResponseWriter, r *http.Request) {
+	posts, _, ok := h.load(w, r, "json")
+	if !ok { return }
+	out := jsonFeed{
+		Version:     "https://jsonfeed.org/version/1.1",
+		Title:       h.site.Title,
+		HomePageURL: h.site.URL,
+		FeedURL:     h.selfURL(r),
+		Items:       []jsonFeedItem{},
+	}
+	for _, p := range posts {
+		it := jsonFeedItem{
+			ID:            h.site.PostGUID(p),
+			URL:           h.site.PostURL(p),
+			Title:         p.Title,
+			ContentHTML:   p.ContentHTML,
+			Summary:       p.Excerpt,
+			DatePublished: postDate(p).UTC().Format(time.RFC3339),
+			DateModified:  p.UpdatedAt.UTC().Format(time.RFC3339),
+			Tags:          p.Tags,
+		}
+		if p.Author != nil { it.Authors = []jsonFeedAuthor{{Name: *p.Author}} }
+		out.Items = append(out.Items, it)
+	}
+	w.Header().Set("Content-Type", "application/feed+json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+// postDate is when a post was published, or created if it has no date.
+func postDate(p *Post) time.Time {
+	if p.PublishedAt != nil { return *p.PublishedAt }
+	return p.CreatedAt
+}
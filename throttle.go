@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ThrottleOptions configures login throttling. Every attempt counts as a
+// failure until it succeeds. After FreeFailures failures of an account
+// each further attempt has to wait twice as long as the previous one, up
+// to MaxDelay; an attempt after MaxFailures locks the account for Lockout.
+// Client IPs have their own, larger budgets, since many users can share
+// one address behind NAT or a proxy. Failures older than Lockout are
+// forgotten.
+type ThrottleOptions struct {
+	FreeFailures   int
+	MaxFailures    int
+	IPFreeFailures int
+	IPMaxFailures  int
+	MaxDelay       time.Duration
+	Lockout        time.Duration
+}
+
+// LoginThrottle counts failed logins per account and per client IP. State
+// lives in the database so that every instance sees the same counters.
+type LoginThrottle struct {
+	db   DB
+	opts ThrottleOptions
+}
+
+func NewLoginThrottle(db DB, opts ThrottleOptions) *LoginThrottle {
+	return &LoginThrottle{db: db, opts: opts}
+}
+
+// accountKey identifies the account a login names. Unknown emails are
+// counted as well, so they are throttled exactly like real accounts.
+func accountKey(u *User, email string) string {
+	if u != nil { return fmt.Sprintf("user:%d", u.ID) }
+	return "email:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipKey(ip string) string { return "ip:" + ip }
+
+// clientIP is the address of the client without port, as set by
+// realIPMiddleware.
+func clientIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil { return host }
+	return r.RemoteAddr
+}
+
+// delay is the wait imposed after n failures of a key allowed free ones.
+func (t *LoginThrottle) delay(n, free int) time.Duration {
+	if n <= free { return 0 }
+	d := time.Second
+	for i := free + 1; i < n && d < t.opts.MaxDelay; i++ { d *= 2 }
+	if d > t.opts.MaxDelay { d = t.opts.MaxDelay }
+	return d
+}
+
+// Attempt reserves a login attempt for the account and the client IP
+// before the credentials are checked, so parallel requests cannot run
+// ahead of the counters. A non-zero wait means the attempt is refused and
+// must not be checked at all. Lockouts go to the audit log.
+func (t *LoginThrottle) Attempt(ctx context.Context, account, ip string) (time.Duration, error) {
+	keys := []struct {
+		key       string
+		free, max int
+	}{{account, t.opts.FreeFailures, t.opts.MaxFailures}, {ipKey(ip), t.opts.IPFreeFailures, t.opts.IPMaxFailures}}
+	// Rows are locked in key order so that concurrent attempts cannot deadlock.
+	sort.Slice(keys, func(i, j int) bool { return keys[i].key < keys[j].key })
+	var wait time.Duration
+	err := withTx(ctx, t.db, func(tx *sql.Tx) error {
+		now := time.Now()
+		type state struct {
+			failures int
+			last     time.Time
+			locked   *time.Time
+		}
+		states := make([]state, len(keys))
+		var lock []int
+		for i, k := range keys {
+			if _, err := tx.ExecContext(ctx, "INSERT INTO login_throttle (key, failures, last_failure_at) VALUES ($1, 0, $2) ON CONFLICT (key) DO NOTHING", k.key, now); err != nil {
+				return err
+			}
+			st := &states[i]
+			err := tx.QueryRowContext(ctx, "SELECT failures, last_failure_at, locked_until FROM login_throttle WHERE key = $1 FOR UPDATE", k.key).Scan(&st.failures, &st.last, &st.locked)
+			if err != nil { return err }
+			if st.locked != nil && st.locked.After(now) {
+				if d := st.locked.Sub(now); d > wait { wait = d }
+				continue
+			}
+			if st.last.Before(now.Add(-t.opts.Lockout)) { st.failures = 0 }
+			if st.failures >= k.max {
+				lock = append(lock, i)
+				if t.opts.Lockout > wait { wait = t.opts.Lockout }
+				continue
+			}
+			if d := st.last.Add(t.delay(st.failures, k.free)).Sub(now); d > wait { wait = d }
+		}
+		for _, i := range lock {
+			until := now.Add(t.opts.Lockout)
+			if _, err := tx.ExecContext(ctx, "UPDATE login_throttle SET failures = 0, last_failure_at = $2, locked_until = $3 WHERE key = $1", keys[i].key, now, until); err != nil {
+				return err
+			}
+			if err := recordAudit(ctx, tx, AuditLoginLocked, nil, keys[i].key, ip, map[string]any{"until": until}); err != nil { return err }
+		}
+		if wait > 0 { return nil }
+		for i, k := range keys {
+			if _, err := tx.ExecContext(ctx, "UPDATE login_throttle SET failures = $2, last_failure_at = $3 WHERE key = $1", k.key, states[i].failures+1, now); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return wait, err
+}
+
+// Succeeded clears the failures of an account after a good login and gives
+// the IP its reserved attempt back.
+func (t *LoginThrottle) Succeeded(ctx context.Context, account, ip string) error {
+	if _, err := t.db.ExecContext(ctx, "DELETE FROM login_throttle WHERE key = $1", account); err != nil { return err }
+	_, err := t.db.ExecContext(ctx, "UPDATE login_throttle SET failures = GREATEST(failures - 1, 0) WHERE key = $1", ipKey(ip))
+	return err
+}
+
+// LoginLock is a throttled key, for admins.
+type LoginLock struct {
+	Key           string     `json:"key"`
+	Failures      int        `json:"failures"`
+	LastFailureAt time.Time  `json:"last_failure_at"`
+	LockedUntil   *time.Time `json:"locked_until"`
+}
+
+// Locks lists the keys that are locked or have recent failures.
+func (t *LoginThrottle) Locks(ctx context.Context) ([]*LoginLock, error) {
+	rows, err := t.db.QueryContext(ctx, `SELECT key, failures, last_failure_at, locked_until FROM login_throttle
+		WHERE locked_until > NOW() OR (failures > 0 AND last_failure_at > $1) ORDER BY last_failure_at DESC`, time.Now().Add(-t.opts.Lockout))
+	if err != nil { return nil, err }
+	defer rows.Close()
+	locks := []*LoginLock{}
+	for rows.Next() {
+		l := &LoginLock{}
+		if err := rows.Scan(&l.Key, &l.Failures, &l.LastFailureAt, &l.LockedUntil); err != nil { return nil, err }
+		locks = append(locks, l)
+	}
+	return locks, rows.Err()
+}
+
+// Unlock clears the failures and lock of key on behalf of an admin.
+func (t *LoginThrottle) Unlock(ctx context.Context, key string, actorID int64, ip string) error {
+	return withTx(ctx, t.db, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, "DELETE FROM login_throttle WHERE key = $1", key)
+		if err != nil { return err }
+		if n, _ := res.RowsAffected(); n == 0 { return ErrNotFound }
+		return recordAudit(ctx, tx, AuditLoginUnlocked, &actorID, key, ip, nil)
+	})
+}
+
+// Purge removes counters that expired before the given time.
+func (t *LoginThrottle) Purge(ctx context.Context, before time.Time) (int64, error) {
+	res, err := t.db.ExecContext(ctx, "DELETE FROM login_throttle WHERE last_failure_at < $1 AND (locked_until IS NULL OR locked_until < $2)",
+		before.Add(-t.opts.Lockout), before)
+	if err != nil { return 0, err }
+	return res.RowsAffected()
+}
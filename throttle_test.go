@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLoginThrottleDelay(t *testing.T) {
+	opts := ThrottleOptions{FreeFailures: 3, IPFreeFailures: 20, MaxDelay: 30 * time.Second}
+	th := &LoginThrottle{opts: opts}
+	tests := []struct {
+		failures, free int
+		want           time.Duration
+	}{
+		{0, opts.FreeFailures, 0},
+		{1, opts.FreeFailures, 0},
+		{3, opts.FreeFailures, 0},
+		{4, opts.FreeFailures, time.Second},
+		{5, opts.FreeFailures, 2 * time.Second},
+		{6, opts.FreeFailures, 4 * time.Second},
+		{8, opts.FreeFailures, 16 * time.Second},
+		{9, opts.FreeFailures, 30 * time.Second},
+		{100, opts.FreeFailures, 30 * time.Second},
+		// A shared IP is not slowed down by a few failures of its users.
+		{4, opts.IPFreeFailures, 0},
+		{20, opts.IPFreeFailures, 0},
+		{21, opts.IPFreeFailures, time.Second},
+		{23, opts.IPFreeFailures, 4 * time.Second},
+		{50, opts.IPFreeFailures, 30 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := th.delay(tt.failures, tt.free); got != tt.want { t.Errorf("delay(%d, %d) = %v, want %v", tt.failures, tt.free, got, tt.want) }
+	}
+	if got := (&LoginThrottle{opts: ThrottleOptions{MaxDelay: 500 * time.Millisecond}}).delay(1, 0); got != 500*time.Millisecond {
+		t.Errorf("delay under a sub-second MaxDelay = %v", got)
+	}
+}
+
+func TestAccountKey(t *testing.T) {
+	tests := []struct {
+		u     *User
+		email string
+		want  string
+	}{
+		{&User{ID: 5}, "Someone@Example.com", "user:5"},
+		{nil, " Someone@Example.COM ", "email:someone@example.com"},
+		{nil, "", "email:"},
+	}
+	for _, tt := range tests {
+		if got := accountKey(tt.u, tt.email); got != tt.want { t.Errorf("accountKey(%v, %q) = %q, want %q", tt.u, tt.email, got, tt.want) }
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	for addr, want := range map[string]string{"192.0.2.1:1234": "192.0.2.1", "[2001:db8::1]:443": "2001:db8::1", "192.0.2.7": "192.0.2.7"} {
+		r := httptest.NewRequest("POST", "/auth/login", nil)
+		r.RemoteAddr = addr
+		if got := clientIP(r); got != want { t.Errorf("clientIP(%q) = %q, want %q", addr, got, want) }
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// TOTP parameters (RFC 6238); authenticator apps assume these.
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	// totpSkew is how many periods a code may be early or late, to allow
+	// for clock drift.
+	totpSkew = 1
+
+	recoveryCodeCount = 10
+	// TokenLoginChallenge is the purpose of the token that links the two
+	// steps of a login with a second factor.
+	TokenLoginChallenge = "login_challenge"
+	loginChallengeTTL   = 5 * time.Minute
+)
+
+var (
+	ErrTOTPEnabled    = errors.New("two-factor authentication is already enabled")
+	ErrTOTPNotEnabled = errors.New("two-factor authentication is not enabled")
+	ErrTOTPNotSetUp   = errors.New("two-factor authentication has not been set up")
+	ErrInvalidOTP     = errors.New("invalid code")
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpCode is the code for a time step: HOTP (RFC 4226) of the step number.
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	off := sum[len(sum)-1] & 0x0f
+	n := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, n%1000000)
+}
+
+// totpMatch returns the time step code is valid for around now, or -1.
+func totpMatch(secret []byte, code string, now time.Time) int64 {
+	step := now.Unix() / totpPeriod
+	for d := int64(-totpSkew); d <= totpSkew; d++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step+d)), []byte(code)) == 1 { return step + d }
+	}
+	return -1
+}
+
+// newRecoveryCode returns a code like "k3v9q-8xw2m".
+func newRecoveryCode() string {
+	b := make([]byte, 7)
+	if _, err := rand.Read(b); err != nil { panic(err) }
+	s := strings.ToLower(totpEncoding.EncodeToString(b))[:10]
+	return s[:5] + "-" + s[5:]
+}
+
+// normalizeOTP strips what people type around codes: spaces and dashes.
+func normalizeOTP(code string) string {
+	return strings.ToLower(strings.NewReplacer(" ", "", "-", "").Replace(code))
+}
+
+// TOTPSetup is what an authenticator app needs to be enrolled.
+type TOTPSetup struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"`
+}
+
+// TwoFactorService handles TOTP second factors and their recovery codes.
+type TwoFactorService struct {
+	db     DB
+	users  *UserService
+	audit  *AuditLog
+	issuer string
+}
+
+func NewTwoFactorService(db DB, users *UserService, audit *AuditLog, issuer string) *TwoFactorService {
+	return &TwoFactorService{db: db, users: users, audit: audit, issuer: issuer}
+}
+
+// Setup generates a new secret for a user without a second factor. It only
+// takes effect once Enable confirms a code from it.
+func (s *TwoFactorService) Setup(ctx context.Context, userID int64) (*TOTPSetup, error) {
+	u, err := s.users.GetByID(ctx, userID)
+	if err != nil { return nil, err }
+	if u.TOTPEnabledAt != nil { return nil, ErrTOTPEnabled }
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil { return nil, err }
+	enc := totpEncoding.EncodeToString(secret)
+	if _, err := s.db.ExecContext(ctx, "UPDATE users SET totp_secret = $1 WHERE id = $2 AND totp_enabled_at IS NULL", enc, userID); err != nil {
+		return nil, err
+	}
+	label := url.PathEscape(s.issuer + ":" + u.Email)
+	q := url.Values{"secret": {enc}, "issuer": {s.issuer}, "algorithm": {"SHA1"}, "digits": {fmt.Sprint(totpDigits)}, "period": {fmt.Sprint(totpPeriod)}}
+	return &TOTPSetup{Secret: enc, URI: "otpauth://totp/" + label + "?" + q.Encode()}, nil
+}
+
+// Enable turns on the second factor after checking a code from the secret
+// of Setup and returns fresh recovery codes.
+func (s *TwoFactorService) Enable(ctx context.Context, userID int64, code string) ([]string, error) {
+	var codes []string
+	err := withTx(ctx, s.db, func(tx *sql.Tx) error {
+		var enabled bool
+		var secret sql.NullString
+		err := tx.QueryRowContext(ctx, "SELECT totp_enabled_at IS NOT NULL, totp_secret FROM users WHERE id = $1 AND deleted_at IS NULL FOR UPDATE", userID).Scan(&enabled, &secret)
+		if errors.Is(err, sql.ErrNoRows) { return ErrNotFound }
+		if err != nil { return err }
+		if enabled { return ErrTOTPEnabled }
+		if !secret.Valid { return ErrTOTPNotSetUp }
+		key, err := totpEncoding.DecodeString(secret.String)
+		if err != nil { return err }
+		step := totpMatch(key, normalizeOTP(code), time.Now())
+		if step < 0 { return ErrInvalidOTP }
+		if _, err := tx.ExecContext(ctx, "UPDATE users SET totp_enabled_at = NOW(), totp_last_step = $2 WHERE id = $1", userID, step); err != nil { return err }
+		if codes, err = replaceRecoveryCodes(ctx, tx, userID); err != nil { return err }
+		return recordAudit(ctx, tx, AuditTOTPEnabled, &userID, fmt.Sprintf("user:%d", userID), "", nil)
+	})
+	return codes, err
+}
+
+// Disable removes the second factor and recovery codes of a user; actorID
+// is who asked, the user themselves or an admin.
+func (s *TwoFactorService) Disable(ctx context.Context, userID, actorID int64) error {
+	return withTx(ctx, s.db, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, `UPDATE users SET totp_secret = NULL, totp_enabled_at = NULL, totp_last_step = NULL
+			WHERE id = $1 AND deleted_at IS NULL AND totp_enabled_at IS NOT NULL`, userID)
+		if err != nil { return err }
+		if n, _ := res.RowsAffected(); n == 0 { return ErrTOTPNotEnabled }
+		if _, err := tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE user_id = $1", userID); err != nil { return err }
+		return recordAudit(ctx, tx, AuditTOTPDisabled, &actorID, fmt.Sprintf("user:%d", userID), "", nil)
+	})
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of a user who proves
+// they still have their authenticator.
+func (s *TwoFactorService) RegenerateRecoveryCodes(ctx context.Context, userID int64, code string) ([]string, error) {
+	var codes []string
+	err := withTx(ctx, s.db, func(tx *sql.Tx) error {
+		if err := verifyTOTP(ctx, tx, userID, normalizeOTP(code)); err != nil { return err }
+		var err error
+		codes, err = replaceRecoveryCodes(ctx, tx, userID)
+		return err
+	})
+	return codes, err
+}
+
+func replaceRecoveryCodes(ctx context.Context, q querier, userID int64) ([]string, error) {
+	if _, err := q.ExecContext(ctx, "DELETE FROM recovery_codes WHERE user_id = $1", userID); err != nil { return nil, err }
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		codes[i] = newRecoveryCode()
+		hashes[i] = hashToken(normalizeOTP(codes[i]))
+	}
+	_, err := q.ExecContext(ctx, "INSERT INTO recovery_codes (user_id, code_hash) SELECT $1, unnest($2::text[])", userID, pq.Array(hashes))
+	return codes, err
+}
+
+// verifyTOTP accepts a current code of the user's authenticator. A code is
+// good for one use only: steps up to the last accepted one are refused.
+func verifyTOTP(ctx context.Context, q querier, userID int64, code string) error {
+	var secret sql.NullString
+	var last sql.NullInt64
+	err := q.QueryRowContext(ctx, "SELECT totp_secret, totp_last_step FROM users WHERE id = $1 AND totp_enabled_at IS NOT NULL", userID).Scan(&secret, &last)
+	if errors.Is(err, sql.ErrNoRows) { return ErrTOTPNotEnabled }
+	if err != nil { return err }
+	key, err := totpEncoding.DecodeString(secret.String)
+	if err != nil { return err }
+	step := totpMatch(key, code, time.Now())
+	if step < 0 || (last.Valid && step <= last.Int64) { return ErrInvalidOTP }
+	res, err := q.ExecContext(ctx, "UPDATE users SET totp_last_step = $2 WHERE id = $1 AND (totp_last_step IS NULL OR totp_last_step < $2)", userID, step)
+	if err != nil { return err }
+	if n, _ := res.RowsAffected(); n == 0 { return ErrInvalidOTP }
+	return nil
+}
+
+// Challenge starts the second step of a login for a user with a second
+// factor and returns the token that Verify needs.
+func (s *TwoFactorService) Challenge(ctx context.Context, userID int64) (string, error) {
+	return issueUserToken(ctx, s.db, userID, TokenLoginChallenge, loginChallengeTTL)
+}
+
+// ChallengeUser returns the user a login challenge was issued to.
+func (s *TwoFactorService) ChallengeUser(ctx context.Context, challenge string) (*User, error) {
+	var userID int64
+	err := s.db.QueryRowContext(ctx, `SELECT user_id FROM user_tokens
+		WHERE token_hash = $1 AND purpose = $2 AND used_at IS NULL AND expires_at > NOW()`, hashToken(challenge), TokenLoginChallenge).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) { return nil, ErrInvalidUserToken }
+	if err != nil { return nil, err }
+	return s.users.GetByID(ctx, userID)
+}
+
+// Verify completes a login challenge with a code from the authenticator or
+// an unused recovery code. The challenge stays usable after a wrong code,
+// until it expires.
+func (s *TwoFactorService) Verify(ctx context.Context, challenge string, u *User, code string, ip string) error {
+	code = normalizeOTP(code)
+	recovery := false
+	err := withTx(ctx, s.db, func(tx *sql.Tx) error {
+		err := verifyTOTP(ctx, tx, u.ID, code)
+		if errors.Is(err, ErrInvalidOTP) && len(code) != totpDigits {
+			res, err := tx.ExecContext(ctx, "UPDATE recovery_codes SET used_at = NOW() WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL", u.ID, hashToken(code))
+			if err != nil { return err }
+			if n, _ := res.RowsAffected(); n == 0 { return ErrInvalidOTP }
+			recovery = true
+		} else if err != nil {
+			return err
+		}
+		userID, err := consumeUserToken(ctx, tx, TokenLoginChallenge, challenge)
+		if err != nil { return err }
+		if userID != u.ID { return ErrInvalidUserToken }
+		return nil
+	})
+	if err == nil && recovery {
+		if err := s.audit.Record(ctx, AuditRecoveryCodeUsed, &u.ID, fmt.Sprintf("user:%d", u.ID), ip, nil); err != nil { log.Printf("audit: %v", err) }
+	}
+	return err
+}
+
+// RecoveryCodesLeft counts the unused recovery codes of a user.
+func (s *TwoFactorService) RecoveryCodesLeft(ctx context.Context, userID int64) (int, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM recovery_codes WHERE user_id = $1 AND used_at IS NULL", userID).Scan(&n)
+	return n, err
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 key of the RFC 6238 test vectors.
+var rfc6238Secret = []byte("12345678901234567890")
+
+// TestTOTPCodeRFC6238 checks the SHA-1 vectors of RFC 6238, appendix B.
+// The RFC lists 8-digit codes; ours are their last 6 digits.
+func TestTOTPCodeRFC6238(t *testing.T) {
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		if got := totpCode(rfc6238Secret, tt.unix/totpPeriod); got != tt.want { t.Errorf("code at %d = %s, want %s", tt.unix, got, tt.want) }
+	}
+}
+
+func TestTOTPMatch(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := now.Unix() / totpPeriod
+	tests := []struct {
+		code string
+		want int64
+	}{
+		{totpCode(rfc6238Secret, step), step},
+		{totpCode(rfc6238Secret, step-1), step - 1},
+		{totpCode(rfc6238Secret, step+1), step + 1},
+		{totpCode(rfc6238Secret, step-2), -1},
+		{totpCode(rfc6238Secret, step+2), -1},
+		{"", -1},
+		{"12345", -1},
+	}
+	for _, tt := range tests {
+		if got := totpMatch(rfc6238Secret, tt.code, now); got != tt.want { t.Errorf("totpMatch(%q) = %d, want %d", tt.code, got, tt.want) }
+	}
+	if got := totpMatch([]byte("another secret"), totpCode(rfc6238Secret, step), now); got != -1 { t.Errorf("code of another secret matched step %d", got) }
+}
+
+func TestNormalizeOTP(t *testing.T) {
+	tests := map[string]string{"123 456": "123456", "123-456": "123456", " K3V9Q-8XW2M ": "k3v9q8xw2m", "": ""}
+	for in, want := range tests {
+		if got := normalizeOTP(in); got != want { t.Errorf("normalizeOTP(%q) = %q, want %q", in, got, want) }
+	}
+}
+
+func TestNewRecoveryCode(t *testing.T) {
+	format := regexp.MustCompile(`^[a-z2-7]{5}-[a-z2-7]{5}$`)
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		c := newRecoveryCode()
+		if !format.MatchString(c) { t.Fatalf("recovery code %q has the wrong format", c) }
+		if len(normalizeOTP(c)) == totpDigits { t.Fatalf("normalized recovery code %q could be taken for a TOTP code", c) }
+		if seen[c] { t.Fatalf("recovery code %q generated twice", c) }
+		seen[c] = true
+	}
+}
@@ -16,18 +16,31 @@ type rss struct {
 			Title       string `xml:"title"`
 			Description string `xml:"description"`
 			PubDate     string `xml:"pubDate"`
+			Author      string `xml:"author"`
+			Creator     string `xml:"http://purl.org/dc/elements/1.1/ creator"`
+			Categories  []string `xml:"category"`
 		} `xml:"item"`
 	} `xml:"channel"`
 }
 
 type atom struct {
 	Entries []struct {
-		Title   string `xml:"title"`
-		Content string `xml:"content"`
-		Updated string `xml:"updated"`
+		Title     string `xml:"title"`
+		Content   string `xml:"content"`
+		Updated   string `xml:"updated"`
+		Published string `xml:"published"`
+		Author    struct {
+			Name string `xml:"name"`
+		} `xml:"author"`
+		Categories []atomCategory `xml:"category"`
 	} `xml:"entry"`
 }
 
+type atomCategory struct {
+	Term  string `xml:"term,attr"`
+	Label string `xml:"label,attr"`
+}
+
 func StartFeedWorker(ctx context.Context, feeds *FeedService, posts *PostService, interval time.Duration) {
 	t := time.NewTicker(interval)
 	defer t.Stop()
@@ -41,6 +54,103 @@ func StartFeedWorker(ctx context.Context, feeds *FeedService, posts *PostService
 	}
 }
 
+// StartPublisher periodically publishes scheduled posts that are due.
+func StartPublisher(ctx context.Context, posts *PostService, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			n, err := posts.PublishDue(ctx)
+			if err != nil {
+				log.Printf("publisher error: %v", err)
+			} else if n > 0 {
+				log.Printf("published %d scheduled posts", n)
+			}
+		}
+	}
+}
+
+// StartTrashPurger periodically removes posts, feeds and users that have
+// been in the trash for longer than retention.
+func StartTrashPurger(ctx context.Context, posts *PostService, feeds *FeedService, users *UserService, retention, interval time.Duration) {
+	purgers := []struct {
+		name  string
+		purge func(context.Context, time.Time) (int64, error)
+	}{
+		{"posts", posts.Purge},
+		{"feeds", feeds.Purge},
+		{"users", users.Purge},
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			before := time.Now().Add(-retention)
+			for _, p := range purgers {
+				n, err := p.purge(ctx, before)
+				if err != nil {
+					log.Printf("trash purge error for %s: %v", p.name, err)
+				} else if n > 0 {
+					log.Printf("purged %d %s from trash", n, p.name)
+				}
+			}
+		}
+	}
+}
+
+// StartAuthPurger periodically removes expired login sessions, together
+// with their refresh tokens, expired user tokens and stale login counters.
+func StartAuthPurger(ctx context.Context, sessions *SessionService, accounts *AccountService, throttle *LoginThrottle, interval time.Duration) {
+	purgers := []struct {
+		name  string
+		purge func(context.Context, time.Time) (int64, error)
+	}{
+		{"sessions", sessions.Purge},
+		{"user tokens", accounts.PurgeTokens},
+		{"login counters", throttle.Purge},
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			for _, p := range purgers {
+				n, err := p.purge(ctx, time.Now())
+				if err != nil {
+					log.Printf("purge error for %s: %v", p.name, err)
+				} else if n > 0 {
+					log.Printf("purged %d expired %s", n, p.name)
+				}
+			}
+		}
+	}
+}
+
+// StartKeyReloader periodically rereads the JWT key directory, picking up
+// new and scheduled keys and retiring removed ones.
+func StartKeyReloader(ctx context.Context, j *JWTManager, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := j.Reload(); err != nil {
+				log.Printf("jwt key reload error: %v", err)
+			}
+		}
+	}
+}
+
 func processFeeds(ctx context.Context, feeds *FeedService, posts *PostService) {
 	flist, err := feeds.List(ctx)
 	if err != nil {
@@ -48,15 +158,15 @@ func processFeeds(ctx context.Context, feeds *FeedService, posts *PostService) {
 		return
 	}
 	for _, f := range flist {
-		if err := fetchAndIngest(ctx, f.URL, posts); err != nil {
+		if err := fetchAndIngest(ctx, f, posts); err != nil {
 			log.Printf("feed fetch error for %s: %v", f.URL, err)
 		}
 	}
 }
 
-func fetchAndIngest(ctx context.Context, url string, posts *PostService) error {
+func fetchAndIngest(ctx context.Context, f *Feed, posts *PostService) error {
 	client := &http.Client{Timeout: 15 * time.Second}
-	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, f.URL, nil)
 	resp, err := client.Do(req)
 	if err != nil { return err }
 	defer resp.Body.Close()
@@ -73,7 +183,15 @@ func fetchAndIngest(ctx context.Context, url string, posts *PostService) error {
 			title := strings.TrimSpace(it.Title)
 			desc := strings.TrimSpace(stripHTML(it.Description))
 			if title == "" && desc == "" { continue }
-			_, _ = posts.Create(ctx, nonEmpty(title, desc), firstNonEmpty(desc, title), strPtr(url), nil)
+			_, _ = posts.Create(ctx, PostInput{
+				Title:       nonEmpty(title, desc),
+				Content:     firstNonEmpty(desc, title),
+				Source:      strPtr(f.URL),
+				FeedID:      &f.ID,
+				Author:      optionalStr(firstNonEmpty(strings.TrimSpace(it.Creator), strings.TrimSpace(it.Author))),
+				PublishedAt: parseFeedDate(it.PubDate),
+				Tags:        feedPostTags(it.Categories),
+			})
 		}
 		return nil
 	}
@@ -84,12 +202,26 @@ func fetchAndIngest(ctx context.Context, url string, posts *PostService) error {
 			title := strings.TrimSpace(e.Title)
 			cnt := strings.TrimSpace(stripHTML(e.Content))
 			if title == "" && cnt == "" { continue }
-			_, _ = posts.Create(ctx, nonEmpty(title, cnt), firstNonEmpty(cnt, title), strPtr(url), nil)
+			_, _ = posts.Create(ctx, PostInput{
+				Title:       nonEmpty(title, cnt),
+				Content:     firstNonEmpty(cnt, title),
+				Source:      strPtr(f.URL),
+				FeedID:      &f.ID,
+				Author:      optionalStr(strings.TrimSpace(e.Author.Name)),
+				PublishedAt: parseFeedDate(firstNonEmpty(e.Published, e.Updated)),
+				Tags:        feedPostTags(atomCategories(e.Categories)),
+			})
 		}
 	}
 	return nil
 }
 
+func atomCategories(cats []atomCategory) []string {
+	var out []string
+	for _, c := range cats { out = append(out, firstNonEmpty(c.Label, c.Term)) }
+	return out
+}
+
 func stripHTML(s string) string {
 	in := false
 	var b strings.Builder
@@ -106,4 +238,19 @@ func stripHTML(s string) string {
 
 func nonEmpty(a, b string) string { if a != "" { return a }; return b }
 func firstNonEmpty(a, b string) string { if a != "" { return a }; return b }
-func strPtr(s string) *string { return &s }
\ No newline at end of file
+func strPtr(s string) *string { return &s }
+func derefString(s *string) string { if s == nil { return "" }; return *s }
+func optionalStr(s string) *string { if s == "" { return nil }; return &s }
+
+var feedDateLayouts = []string{time.RFC1123Z, time.RFC1123, time.RFC3339, time.RFC822Z, time.RFC822, "Mon, 2 Jan 2006 15:04:05 -0700", "2 Jan 2006 15:04:05 -0700"}
+
+// parseFeedDate understands the RSS (RFC 822) and Atom (RFC 3339) date
+// formats; unparseable dates yield nil.
+func parseFeedDate(s string) *time.Time {
+	s = strings.TrimSpace(s)
+	if s == "" { return nil }
+	for _, layout := range feedDateLayouts {
+		if t, err := time.Parse(layout, s); err == nil { return &t }
+	}
+	return nil
+}
\ No newline at end of file